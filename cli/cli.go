@@ -6,19 +6,23 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/json"
 	"encoding/pem"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/eggsampler/acme/v3"
 	"github.com/nicennnnnnnlee/cert_bot/dns01"
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+	"github.com/nicennnnnnnlee/cert_bot/httpclient"
 )
 
 var (
@@ -30,6 +34,18 @@ var (
 	exitIfDns01NotValid bool
 	certFile            string
 	keyFile             string
+	preferredChain      string
+	profile             string
+	ipChallenge         string
+	http01Addr          string
+	tlsAlpn01Addr       string
+	csrFile             string
+	csrOptions          engine.CSROptions
+	notBefore           string
+	notAfter            string
+	skipChecks          bool
+	rootsFile           string
+	httpOptions         httpclient.Options
 	dialer              net.Dialer
 	dnsServer           string
 	txtMaxCheck         int
@@ -43,9 +59,11 @@ type acmeAccountFile struct {
 }
 
 func Main() {
-	flag.StringVar(&directoryUrl, "dirurl", acme.LetsEncryptProduction,
-		// flag.StringVar(&directoryUrl, "dirurl", acme.LetsEncryptStaging,
-		"acme directory url - defaults to lets encrypt v2 staging url if not provided.\n LetsEncryptProduction = https://acme-v02.api.letsencrypt.org/directory\n LetsEncryptStaging = https://acme-staging-v02.api.letsencrypt.org/directory \n ZeroSSLProduction = https://acme.zerossl.com/v2/DV90")
+	flag.StringVar(&directoryUrl, "dirurl", "letsencrypt",
+		// flag.StringVar(&directoryUrl, "dirurl", "letsencrypt-staging",
+		"acme directory url or preset name - defaults to lets encrypt v2 production if not provided.\n"+
+			" A comma separated list is tried in order when a CA is rate limited or unavailable, each CA has its own account file.\n"+
+			presetsUsage())
 	flag.StringVar(&contactsList, "contact", "",
 		"a list of comma separated contact emails to use when creating a new account (optional, dont include 'mailto:' prefix)")
 	flag.StringVar(&domains, "domains", "",
@@ -55,7 +73,19 @@ func Main() {
 	flag.StringVar(&dns01File, "dns01file", "dns01.json",
 		"the file that the dns01 json data will be loaded from (will exit if not exists)")
 	flag.StringVar(&dnsServer, "dnsserver", "8.8.8.8:53",
-		"dnsServer to check txt record")
+		"dnsServer to check txt record and CAA records")
+	flag.BoolVar(&skipChecks, "skipchecks", false,
+		"skip the CAA and DNS checks before creating the order")
+	flag.StringVar(&rootsFile, "roots", "",
+		"a pem bundle of the roots the issued chain must build to (optional, defaults to the system roots)")
+	flag.StringVar(&httpOptions.CABundle, "cabundle", "",
+		"a pem bundle of roots trusted in addition to the system roots for https requests, e.g. of a private acme CA (optional)")
+	flag.StringVar(&httpOptions.Proxy, "proxy", "",
+		"the proxy of the requests to the acme CA and dns providers, http://, https:// or socks5:// (optional)")
+	flag.StringVar(&httpOptions.Timeout, "timeout", "30s",
+		"the timeout of a http request")
+	flag.StringVar(&httpOptions.UserAgent, "useragent", "",
+		"the user agent of the http requests (optional)")
 	flag.BoolVar(&exitIfDns01NotValid, "exitifdns01fail", true,
 		"exit if dns01 config is not valid, or just manualy set dns txt record")
 	flag.IntVar(&countBeforeTxtCheck, "countBeforeTxtCheck", 2,
@@ -68,12 +98,53 @@ func Main() {
 		"the file that the pem encoded certificate chain will be saved to")
 	flag.StringVar(&keyFile, "keyfile", "privkey.pem",
 		"the file that the pem encoded certificate private key will be saved to")
+	flag.StringVar(&preferredChain, "preferredchain", "",
+		"the common name of the root the certificate chain should be issued by, e.g. \"ISRG Root X1\" (optional, the CA's default chain is used if no alternate chain matches)")
+	flag.StringVar(&profile, "profile", "",
+		"the certificate profile advertised by the CA, e.g. shortlived, tlsserver (optional)")
+	flag.StringVar(&ipChallenge, "ipchallenge", acme.ChallengeTypeHTTP01,
+		"the challenge used for ip address identifiers, served in-process: http-01 or tls-alpn-01")
+	flag.StringVar(&http01Addr, "http01addr", ":80",
+		"the address the in-process http-01 responder listens on, used for ip address identifiers")
+	flag.StringVar(&tlsAlpn01Addr, "tlsalpn01addr", ":443",
+		"the address the in-process tls-alpn-01 responder listens on, used for ip address identifiers")
+	flag.StringVar(&csrFile, "csr", "",
+		"a pem encoded csr file to finalize as-is, the domains are taken from its SANs and no private key is written (optional)")
+	flag.StringVar(&csrOptions.CommonName, "cn", "",
+		"the common name of the certificate, it must be one of the domains (optional, defaults to the first domain)")
+	flag.BoolVar(&csrOptions.NoCommonName, "nocn", false,
+		"leave the common name empty, for SAN-only certificates")
+	flag.BoolVar(&csrOptions.MustStaple, "muststaple", false,
+		"request the OCSP must-staple (TLS feature) extension")
+	flag.StringVar(&csrOptions.Organization, "org", "",
+		"the organization of the certificate subject (optional)")
+	flag.StringVar(&csrOptions.OrganizationalUnit, "ou", "",
+		"the organizational unit of the certificate subject (optional)")
+	flag.StringVar(&csrOptions.Country, "country", "",
+		"the country of the certificate subject, a two-letter code like US (optional)")
+	flag.StringVar(&csrOptions.Province, "province", "",
+		"the state or province of the certificate subject (optional)")
+	flag.StringVar(&csrOptions.Locality, "locality", "",
+		"the locality (city) of the certificate subject (optional)")
+	flag.StringVar(&notBefore, "notbefore", "",
+		"the notBefore of the order, a RFC 3339 time or a duration from now like 1h (optional, not every CA supports it)")
+	flag.StringVar(&notAfter, "notafter", "",
+		"the notAfter of the order, a RFC 3339 time or a duration from now like 168h (optional, not every CA supports it)")
 	flag.Parse()
 
+	if err := httpclient.SetDefault(httpOptions); err != nil {
+		log.Fatalf("%v", err)
+	}
+
 	// check domains are provided
-	if domains == "" {
+	if domains == "" && csrFile == "" {
 		log.Fatal("No domains provided")
 	}
+	if csrFile == "" {
+		if _, err := engine.ParseDomainList(domains); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
 
 	dns01, err := dns01.FromFile(dns01File)
 	if err != nil {
@@ -85,41 +156,164 @@ func Main() {
 		}
 	}
 
+	dirUrls := engine.DirectoryUrls(strings.Split(directoryUrl, ",")...)
+	for i, dirUrl := range dirUrls {
+		err = issue(dirUrl, accountFileOf(i, dirUrl), dns01)
+		if err == nil {
+			break
+		}
+		if i == len(dirUrls)-1 || !engine.IsFailoverError(err) {
+			exitWithError(err)
+		}
+		log.Println(err)
+		log.Printf("Retrying with next CA: %s", dirUrls[i+1])
+	}
+
+	log.Printf("Done.")
+}
+
+// exit codes of the acme error classes, 1 for other errors
+var exitCodes = map[string]int{
+	engine.ClassRateLimited:    2,
+	engine.ClassUnauthorized:   3,
+	engine.ClassDNS:            4,
+	engine.ClassConnection:     5,
+	engine.ClassServerInternal: 6,
+	engine.ClassBadNonce:       7,
+}
+
+// exitWithError logs err with its acme problem type and subproblems, and exits with the code of its class
+func exitWithError(err error) {
+	log.Println(err)
+	problem := engine.Problem(err)
+	if problem.Type != "" {
+		log.Printf("Problem type: %s", problem.Type)
+	}
+	for _, sub := range problem.SubProblems {
+		log.Printf("Subproblem %s: %s (%s)", sub.Identifier.Value, sub.Detail, sub.Type)
+	}
+	code, ok := exitCodes[problem.Class]
+	if !ok {
+		code = 1
+	}
+	os.Exit(code)
+}
+
+// accountFileOf returns the account file of the i-th CA, the fallback CAs use their own account
+// e.g. account.json, account.zerossl.json
+func accountFileOf(i int, dirUrl string) string {
+	if i == 0 {
+		return accountFile
+	}
+	name := engine.PresetName(dirUrl)
+	if name == "" {
+		if u, err := url.Parse(dirUrl); err == nil {
+			name = u.Hostname()
+		}
+	}
+	ext := filepath.Ext(accountFile)
+	return strings.TrimSuffix(accountFile, ext) + "." + name + ext
+}
+
+func issue(directoryUrl string, accountFile string, dns01 dns01.DNS01) error {
 	// create a new acme client given a provided (or default) directory url
+	// the roots are loaded before ordering, a chain that can not be verified is not worth an order
+	roots, err := engine.RootsFor(directoryUrl, rootsFile)
+	if err != nil {
+		return err
+	}
+
 	log.Printf("Connecting to acme directory url: %s", directoryUrl)
-	client, err := acme.NewClient(directoryUrl)
+	// the errors of the acme client drop the Retry-After of the CA, the recorder keeps it
+	httpClient, retryAfter := engine.RecordRetryAfter(httpclient.Default())
+	clientOptions := []acme.OptionFunc{acme.WithHTTPClient(httpClient)}
+	if httpOptions.UserAgent != "" {
+		// the acme client sends its own user agent, ours is appended
+		clientOptions = append(clientOptions, acme.WithUserAgentSuffix(httpOptions.UserAgent))
+	}
+	client, err := acme.NewClient(directoryUrl, clientOptions...)
 	if err != nil {
-		log.Fatalf("Error connecting to acme directory: %v", err)
+		return engine.Failover(fmt.Errorf("error connecting to acme directory: %v", err))
 	}
 
 	// attempt to load an existing account from file
 	log.Printf("Loading account file %s", accountFile)
-	account, err := loadAccount(client)
+	account, err := loadAccount(client, accountFile)
 	if err != nil {
 		log.Printf("Error loading existing account: %v", err)
 		// if there was an error loading an account, just create a new one
 		log.Printf("Creating new account")
-		account, err = createAccount(client)
+		account, err = createAccount(client, accountFile)
 		if err != nil {
-			log.Fatalf("Error creaing new account: %v", err)
+			return fmt.Errorf("error creaing new account: %w", err)
 		}
 	}
 	log.Printf("Account url: %s", account.URL)
 
-	// collect the comma separated domains into acme identifiers
-	domainList := strings.Split(domains, ",")
+	// collect the comma separated domains into acme identifiers, or the SANs of the csr file
+	var userCsr *x509.CertificateRequest
 	var ids []acme.Identifier
-	for _, domain := range domainList {
-		ids = append(ids, acme.Identifier{Type: "dns", Value: domain})
+	if csrFile != "" {
+		userCsr, err = engine.LoadCSR(csrFile)
+		if err != nil {
+			return err
+		}
+		ids = engine.CSRIdentifiers(userCsr)
+	} else {
+		domainList, err := engine.ParseDomainList(domains)
+		if err != nil {
+			return err
+		}
+		ids = domainList.Identifiers()
 	}
+	domainList := engine.IdentifierValues(ids)
 
-	// create a new order with the acme service given the provided identifiers
-	log.Printf("Creating new order for domains: %s", domainList)
-	order, err := client.NewOrder(account, ids)
+	// resume the order of a previous run that was interrupted, while it is still pending or ready
+	statePath := engine.OrderStatePath(certFile)
+	state, err := engine.LoadOrderState(statePath)
 	if err != nil {
-		log.Fatalf("Error creating new order: %v", err)
+		log.Printf("Ignoring order state: %v", err)
+	}
+	var order acme.Order
+	if state.Matches(directoryUrl, account.URL, ids) {
+		log.Printf("Resuming order: %s", state.OrderUrl)
+		order, err = engine.ResumeOrder(client, account, state)
+		if err != nil {
+			log.Printf("Can not resume order: %v", err)
+			state = nil
+		}
+	} else {
+		state = nil
+	}
+
+	if state == nil {
+		// fail fast if CAA records do not allow this CA
+		if !skipChecks {
+			if err := preflight(directoryUrl, account.URL, ids); err != nil {
+				return err
+			}
+		}
+
+		// create a new order with the acme service given the provided identifiers
+		log.Printf("Creating new order for domains: %s", domainList)
+		orderOptions := engine.OrderOptions{Profile: profile}
+		if orderOptions.NotBefore, err = engine.ParseOrderTime(notBefore, time.Now()); err != nil {
+			return fmt.Errorf("-notbefore is not valid: %v", err)
+		}
+		if orderOptions.NotAfter, err = engine.ParseOrderTime(notAfter, time.Now()); err != nil {
+			return fmt.Errorf("-notafter is not valid: %v", err)
+		}
+		err = engine.Retry("creating new order", engine.DefaultRetryPolicy, log.Printf, func() (err error) {
+			order, err = engine.NewOrder(client, account, directoryUrl, ids, orderOptions)
+			return retryAfter.Attach(err)
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Order created: %s", order.URL)
+		state = engine.NewOrderState(directoryUrl, account.URL, order, ids)
+		saveOrderState(state, statePath)
 	}
-	log.Printf("Order created: %s", order.URL)
 
 	// loop through each of the provided authorization urls
 	dMap := make(map[string]interface{})
@@ -128,130 +322,200 @@ func Main() {
 		log.Printf("Fetching authorization: %s", authUrl)
 		auth, err := client.FetchAuthorization(account, authUrl)
 		if err != nil {
-			log.Fatalf("Error fetching authorization url %q: %v", authUrl, err)
+			return fmt.Errorf("error fetching authorization url %q: %w", authUrl, err)
 		}
 		log.Printf("Fetched authorization: %s", auth.Identifier.Value)
-
-		chal, ok := auth.ChallengeMap[acme.ChallengeTypeDNS01]
-		if !ok {
-			log.Fatalf("Unable to find dns challenge for auth %s", auth.Identifier.Value)
+		if auth.Status == "valid" {
+			log.Printf("Authorization %s is already valid", auth.Identifier.Value)
+			state.SetAuthorization(authUrl, auth.Status)
+			saveOrderState(state, statePath)
+			continue
 		}
-		txt := acme.EncodeDNS01KeyAuthorization(chal.KeyAuthorization)
 
-		log.Println("TXT record to set:", txt)
-		if dns01 != nil {
-			if _, ok := dMap[auth.Identifier.Value]; !ok {
-				dns01.DeleteTXT(auth.Identifier.Value)
-				dMap[auth.Identifier.Value] = nil
-			}
-			err = dns01.SetTXT(txt)
+		var chal acme.Challenge
+		if auth.Identifier.Type == "ip" {
+			// ip identifiers can not be validated by dns-01
+			var cleanup func()
+			chal, cleanup, err = solveIp(auth)
 			if err != nil {
-				log.Fatalf("Error set txt record: %v", err)
-			}
-			// wait for record refresh
-			for i := 1; i <= countBeforeTxtCheck; i++ {
-				log.Printf("Wait %ds, let the txt record update", i*5)
-				time.Sleep(time.Second * 5)
+				return err
 			}
-			// wait for record refresh
-			for i := 1; i <= txtMaxCheck; i++ {
-				log.Printf("Wait %ds, let the txt record update\n", i*5)
-				time.Sleep(time.Second * 5)
-				err = checkTxtRecord(auth.Identifier.Value, txt)
-				if err != nil {
-					log.Println(err)
-				} else {
-					break
-				}
-			}
-			if err != nil {
-				log.Println("txt record do not match after a long time")
+			defer cleanup()
+		} else {
+			var ok bool
+			chal, ok = auth.ChallengeMap[acme.ChallengeTypeDNS01]
+			if !ok {
+				return fmt.Errorf("unable to find dns challenge for auth %s", auth.Identifier.Value)
 			}
-
-			for i := 1; i <= countAfterTxtCheck; i++ {
-				log.Printf("Wait %ds, let the txt record update", i*5)
-				time.Sleep(time.Second * 5)
+			if err := solveDns01(auth, chal, dns01, dMap); err != nil {
+				return err
 			}
-
-		} else {
-			var input string
-			log.Println("Please Press Enter after txt record is set：")
-			fmt.Scanln(&input)
-			log.Println("Please ensure again:")
-			fmt.Scanln(&input)
 		}
 		// update the acme server that the challenge file is ready to be queried
 		log.Printf("Updating challenge for authorization %s: %s", auth.Identifier.Value, chal.URL)
-		chal, err = client.UpdateChallenge(account, chal)
+		err = engine.Retry("updating authorization "+auth.Identifier.Value+" challenge", engine.DefaultRetryPolicy, log.Printf, func() (err error) {
+			updated, err := client.UpdateChallenge(account, chal)
+			if err == nil {
+				chal = updated
+			}
+			return retryAfter.Attach(err)
+		})
 		if err != nil {
-			log.Fatalf("Error updating authorization %s challenge: %v", auth.Identifier.Value, err)
+			return err
 		}
 		log.Printf("Challenge updated")
+		state.SetAuthorization(authUrl, chal.Status)
+		saveOrderState(state, statePath)
 	}
 
 	// all the challenges should now be completed
 
-	// create a csr for the new certificate
-	log.Printf("Generating certificate private key")
-	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		log.Fatalf("Error generating certificate key: %v", err)
-	}
-
-	b := key2pem(certKey)
-
-	// write the key to the key file as a pem encoded key
-	log.Printf("Writing key file: %s", keyFile)
-	if err := os.WriteFile(keyFile, b, 0600); err != nil {
-		log.Fatalf("Error writing key file %q: %v", keyFile, err)
-	}
-
-	// create the new csr template
-	log.Printf("Creating csr")
-	tpl := &x509.CertificateRequest{
-		SignatureAlgorithm: x509.ECDSAWithSHA256,
-		PublicKeyAlgorithm: x509.ECDSA,
-		PublicKey:          certKey.Public(),
-		Subject:            pkix.Name{CommonName: domainList[0]},
-		DNSNames:           domainList,
-	}
-	csrDer, err := x509.CreateCertificateRequest(rand.Reader, tpl, certKey)
-	if err != nil {
-		log.Fatalf("Error creating certificate request: %v", err)
-	}
-	csr, err := x509.ParseCertificateRequest(csrDer)
-	if err != nil {
-		log.Fatalf("Error parsing certificate request: %v", err)
+	csr := userCsr
+	var certKey *ecdsa.PrivateKey
+	if csr != nil {
+		log.Printf("Using csr file %s, no private key is written", csrFile)
+	} else {
+		// the key is saved with the order, a resumed order is finalized with the same key
+		certKey, err = state.PlannedKey()
+		if err != nil {
+			return err
+		}
+		saveOrderState(state, statePath)
+		log.Printf("Creating csr")
+		csr, err = engine.CreateCSR(certKey, ids, csrOptions)
+		if err != nil {
+			return err
+		}
 	}
 
 	// finalize the order with the acme server given a csr
 	log.Printf("Finalising order: %s", order.URL)
-	order, err = client.FinalizeOrder(account, order, csr)
+	err = engine.Retry("finalizing order", engine.DefaultRetryPolicy, log.Printf, func() (err error) {
+		finalized, err := client.FinalizeOrder(account, order, csr)
+		if err == nil {
+			order = finalized
+		}
+		return retryAfter.Attach(err)
+	})
 	if err != nil {
-		log.Fatalf("Error finalizing order: %v", err)
+		return err
 	}
 
 	// fetch the certificate chain from the finalized order provided by the acme server
 	log.Printf("Fetching certificate: %s", order.Certificate)
-	certs, err := client.FetchCertificates(account, order.Certificate)
+	certs, err := engine.FetchCertificates(client, account, order.Certificate, preferredChain)
 	if err != nil {
-		log.Fatalf("Error fetching order certificates: %v", err)
+		return fmt.Errorf("error fetching order certificates: %w", err)
+	}
+	log.Printf("Certificate chain issued by: %s", engine.ChainIssuer(certs))
+
+	// verify the chain before anything is written, a broken certificate is not deployed
+	log.Printf("Verifying certificate chain")
+	if err := engine.VerifyChain(certs, engine.VerifyOptions{PublicKey: csr.PublicKey, Identifiers: ids, Roots: roots}); err != nil {
+		return err
 	}
 
-	// write the pem encoded certificate chain to file
+	// write the pem encoded certificate chain and key, both or neither
 	log.Printf("Saving certificate to: %s", certFile)
-	var pemData []string
-	for _, c := range certs {
-		pemData = append(pemData, strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{
-			Type:  "CERTIFICATE",
-			Bytes: c.Raw,
-		}))))
+	var keyPem []byte
+	if certKey != nil {
+		log.Printf("Writing key file: %s", keyFile)
+		keyPem = key2pem(certKey)
 	}
-	if err := os.WriteFile(certFile, []byte(strings.Join(pemData, "\n")), 0600); err != nil {
-		log.Fatalf("Error writing certificate file %q: %v", certFile, err)
+	if err := engine.WriteCertificate(certFile, certs, keyFile, keyPem); err != nil {
+		return err
+	}
+	log.Printf("Certificate expires at %s, renew after %s", certs[0].NotAfter, engine.RenewalTime(certs[0]))
+	if err := engine.RemoveOrderState(statePath); err != nil {
+		log.Print(err)
 	}
 
-	log.Printf("Done.")
+	return nil
+}
+
+func presetsUsage() string {
+	var names []string
+	for name := range engine.DirectoryPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf(" %s = %s", name, engine.DirectoryPresets[name]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// saveOrderState saves the progress of the order, a failure is only logged
+func saveOrderState(state *engine.OrderState, statePath string) {
+	if err := state.Save(statePath); err != nil {
+		log.Print(err)
+	}
+}
+
+func solveDns01(auth acme.Authorization, chal acme.Challenge, dns01 dns01.DNS01, dMap map[string]interface{}) (err error) {
+	txt := acme.EncodeDNS01KeyAuthorization(chal.KeyAuthorization)
+
+	log.Println("TXT record to set:", txt)
+	if dns01 != nil {
+		if _, ok := dMap[auth.Identifier.Value]; !ok {
+			dns01.DeleteTXT(auth.Identifier.Value)
+			dMap[auth.Identifier.Value] = nil
+		}
+		err = dns01.SetTXT(txt)
+		if err != nil {
+			return fmt.Errorf("error set txt record: %w", err)
+		}
+		// wait for record refresh
+		for i := 1; i <= countBeforeTxtCheck; i++ {
+			log.Printf("Wait %ds, let the txt record update", i*5)
+			time.Sleep(time.Second * 5)
+		}
+		// wait for record refresh
+		for i := 1; i <= txtMaxCheck; i++ {
+			log.Printf("Wait %ds, let the txt record update\n", i*5)
+			time.Sleep(time.Second * 5)
+			err = checkTxtRecord(auth.Identifier.Value, txt)
+			if err != nil {
+				log.Println(err)
+			} else {
+				break
+			}
+		}
+		if err != nil {
+			log.Println("txt record do not match after a long time")
+		}
+
+		for i := 1; i <= countAfterTxtCheck; i++ {
+			log.Printf("Wait %ds, let the txt record update", i*5)
+			time.Sleep(time.Second * 5)
+		}
+
+	} else {
+		var input string
+		log.Println("Please Press Enter after txt record is set：")
+		fmt.Scanln(&input)
+		log.Println("Please ensure again:")
+		fmt.Scanln(&input)
+	}
+	return nil
+}
+
+func preflight(directoryUrl string, accountUrl string, ids []acme.Identifier) error {
+	log.Printf("Checking CAA and DNS records")
+	dir, err := engine.FetchDirectory(httpclient.Default(), directoryUrl)
+	if err != nil {
+		return err
+	}
+	report := engine.Preflight(ids, engine.PreflightOptions{
+		DNSServer:    dnsServer,
+		CAIdentities: dir.Meta.CaaIdentities,
+		AccountURI:   accountUrl,
+	})
+	for _, line := range report.Lines() {
+		log.Print(line)
+	}
+	return report.Err()
 }
 
 func checkTxtRecord(identifier, expectedValue string) error {
@@ -277,7 +541,7 @@ func checkTxtRecord(identifier, expectedValue string) error {
 	return fmt.Errorf("expected %s, found %s", expectedValue, txts)
 }
 
-func loadAccount(client acme.Client) (acme.Account, error) {
+func loadAccount(client acme.Client, accountFile string) (acme.Account, error) {
 	raw, err := os.ReadFile(accountFile)
 	if err != nil {
 		return acme.Account{}, fmt.Errorf("error reading account file %q: %v", accountFile, err)
@@ -288,19 +552,19 @@ func loadAccount(client acme.Client) (acme.Account, error) {
 	}
 	account, err := client.UpdateAccount(acme.Account{PrivateKey: pem2key([]byte(aaf.PrivateKey)), URL: aaf.Url}, getContacts()...)
 	if err != nil {
-		return acme.Account{}, fmt.Errorf("error updating existing account: %v", err)
+		return acme.Account{}, fmt.Errorf("error updating existing account: %w", err)
 	}
 	return account, nil
 }
 
-func createAccount(client acme.Client) (acme.Account, error) {
+func createAccount(client acme.Client, accountFile string) (acme.Account, error) {
 	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return acme.Account{}, fmt.Errorf("error creating private key: %v", err)
 	}
 	account, err := client.NewAccount(privKey, false, true, getContacts()...)
 	if err != nil {
-		return acme.Account{}, fmt.Errorf("error creating new account: %v", err)
+		return acme.Account{}, fmt.Errorf("error creating new account: %w", err)
 	}
 	raw, err := json.Marshal(acmeAccountFile{PrivateKey: string(key2pem(privKey)), Url: account.URL})
 	if err != nil {
@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/eggsampler/acme/v3"
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+var (
+	http01Responder    *engine.HTTP01Responder
+	tlsAlpn01Responder *engine.TLSALPN01Responder
+)
+
+// solveIp serves the challenge of an ip identifier in-process, the responder is started on first use
+func solveIp(auth acme.Authorization) (acme.Challenge, func(), error) {
+	chal, ok := auth.ChallengeMap[ipChallenge]
+	if !ok {
+		return chal, nil, fmt.Errorf("unable to find %s challenge for auth %s", ipChallenge, auth.Identifier.Value)
+	}
+	switch ipChallenge {
+	case acme.ChallengeTypeHTTP01:
+		if http01Responder == nil {
+			log.Printf("Running http-01 responder at %s", http01Addr)
+			l, err := net.Listen("tcp", http01Addr)
+			if err != nil {
+				return chal, nil, fmt.Errorf("error starting http-01 responder: %v", err)
+			}
+			http01Responder = &engine.HTTP01Responder{}
+			go http.Serve(l, http01Responder)
+		}
+		http01Responder.Add(chal.Token, chal.KeyAuthorization)
+		return chal, func() { http01Responder.Remove(chal.Token) }, nil
+	case acme.ChallengeTypeTLSALPN01:
+		if tlsAlpn01Responder == nil {
+			log.Printf("Running tls-alpn-01 responder at %s", tlsAlpn01Addr)
+			l, err := net.Listen("tcp", tlsAlpn01Addr)
+			if err != nil {
+				return chal, nil, fmt.Errorf("error starting tls-alpn-01 responder: %v", err)
+			}
+			tlsAlpn01Responder = &engine.TLSALPN01Responder{}
+			go tlsAlpn01Responder.Serve(l)
+		}
+		if err := tlsAlpn01Responder.Add(auth.Identifier, chal.KeyAuthorization); err != nil {
+			return chal, nil, fmt.Errorf("error creating authorization %s challenge certificate: %v", auth.Identifier.Value, err)
+		}
+		return chal, func() { tlsAlpn01Responder.Remove(auth.Identifier) }, nil
+	}
+	return chal, nil, fmt.Errorf("ip challenge %s is not supported, use http-01 or tls-alpn-01", ipChallenge)
+}
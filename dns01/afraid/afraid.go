@@ -11,9 +11,9 @@ import (
 	url_tool "net/url"
 	"regexp"
 	"strings"
-	"time"
 
 	"github.com/nicennnnnnnlee/cert_bot/dns01/common"
+	"github.com/nicennnnnnnlee/cert_bot/httpclient"
 )
 
 func init() {
@@ -29,6 +29,7 @@ func option(ds *common.DNS01Setting) (common.DNS01, error) {
 	if err != nil {
 		return nil, fmt.Errorf("dns config of '%s' is not valid: %v", ds.Type, err)
 	}
+	dns01.client = ds.HTTPClient()
 	return &dns01, nil
 }
 
@@ -41,6 +42,24 @@ var (
 type Afraid struct {
 	DSNCookie string `json:"dns_cookie"`
 	DomainId  string `json:"domain_id"`
+
+	client *http.Client
+}
+
+func (af *Afraid) httpClient() *http.Client {
+	if af.client != nil {
+		return af.client
+	}
+	return httpclient.Default()
+}
+
+// noRedirectClient returns a copy of the http client that does not follow redirects
+func (af *Afraid) noRedirectClient() *http.Client {
+	c := *af.httpClient()
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &c
 }
 
 func (n *Afraid) UnmarshalJSON(data []byte) error {
@@ -89,7 +108,7 @@ func (af *Afraid) SetTXT(txt string) (err error) {
 	}
 	req.Header.Set("Cookie", "dns_cookie="+af.DSNCookie)
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	c := &http.Client{Timeout: 10 * time.Second}
+	c := af.httpClient()
 	resp, err := c.Do(req)
 	if err != nil {
 		return fmt.Errorf("afraid: error sending request: %v", err)
@@ -113,11 +132,7 @@ func (af *Afraid) deleteTXTById(recordId string) (err error) {
 	url := "https://freedns.afraid.org/subdomain/delete2.php?submit=delete&data_id[]=" + recordId
 	req, _ := http.NewRequest(http.MethodGet, url, nil)
 	req.Header.Set("Cookie", "dns_cookie="+af.DSNCookie)
-	c := &http.Client{
-		Timeout: 10 * time.Second,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		}}
+	c := af.noRedirectClient()
 	resp, err := c.Do(req)
 	if err != nil {
 		return err
@@ -131,11 +146,7 @@ func (af *Afraid) iteratorTxtRecord(identifier string, deleteFunc func(dataId st
 	url := "https://freedns.afraid.org/subdomain/"
 	req, _ := http.NewRequest(http.MethodGet, url, nil)
 	req.Header.Set("Cookie", "dns_cookie="+af.DSNCookie)
-	c := &http.Client{
-		Timeout: 10 * time.Second,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		}}
+	c := af.noRedirectClient()
 	resp, err := c.Do(req)
 	if err != nil {
 		return err
@@ -8,9 +8,9 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"time"
 
 	"github.com/nicennnnnnnlee/cert_bot/dns01/common"
+	"github.com/nicennnnnnnlee/cert_bot/httpclient"
 )
 
 func init() {
@@ -27,6 +27,7 @@ func option(ds *common.DNS01Setting) (common.DNS01, error) {
 	if err != nil {
 		return nil, fmt.Errorf("dns config of '%s' is not valid: %v", ds.Type, err)
 	}
+	dns01.client = ds.HTTPClient()
 	return &dns01, nil
 }
 
@@ -36,6 +37,15 @@ type Cloudflare struct {
 	Domain   string `json:"domain"`
 	ZoneId   string `json:"zoneId"`
 	// AccountId string `json:"accountId"`
+
+	client *http.Client
+}
+
+func (cf *Cloudflare) httpClient() *http.Client {
+	if cf.client != nil {
+		return cf.client
+	}
+	return httpclient.Default()
 }
 
 func (n *Cloudflare) UnmarshalJSON(data []byte) error {
@@ -57,7 +67,7 @@ type txtRecord struct {
 	Type    string `json:"type"`
 	Name    string `json:"name"`
 	Content string `json:"content"`
-	TTL     int `json:"ttl"`
+	TTL     int    `json:"ttl"`
 }
 
 func (cf *Cloudflare) setAuth(header http.Header) {
@@ -107,7 +117,7 @@ func (cf *Cloudflare) DeleteTXT(identifier string) (err error) {
 		cf.ZoneId, identifier)
 	req, _ := http.NewRequest(http.MethodGet, url, nil)
 	cf.setAuth(req.Header)
-	c := &http.Client{Timeout: 10 * time.Second}
+	c := cf.httpClient()
 	resp, err := c.Do(req)
 	if err != nil {
 		return err
@@ -163,7 +173,7 @@ func (cf *Cloudflare) SetTXT(txt string) (err error) {
 		return fmt.Errorf("cloudflare: error creating request: %v", err)
 	}
 	cf.setAuth(req.Header)
-	c := &http.Client{Timeout: 10 * time.Second}
+	c := cf.httpClient()
 	resp, err := c.Do(req)
 	if err != nil {
 		return fmt.Errorf("cloudflare: error sending request: %v", err)
@@ -240,7 +250,7 @@ func (cf *Cloudflare) initZoneId() (err error) {
 		return fmt.Errorf("cloudflare: error creating request: %v", err)
 	}
 	cf.setAuth(req.Header)
-	c := &http.Client{Timeout: 10 * time.Second}
+	c := cf.httpClient()
 	resp, err := c.Do(req)
 	if err != nil {
 		return fmt.Errorf("cloudflare: error sending request: %v", err)
@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+
+	"github.com/nicennnnnnnlee/cert_bot/httpclient"
 )
 
 type DNS01Option func(*DNS01Setting) (DNS01, error)
@@ -23,6 +26,16 @@ type DNS01 interface {
 type DNS01Setting struct {
 	Type   string          `json:"type"`
 	Config json.RawMessage `json:"config"`
+	// Client is the http client of the provider, the default client if nil
+	Client *http.Client `json:"-"`
+}
+
+// HTTPClient returns the http client the provider should send its requests with
+func (ds *DNS01Setting) HTTPClient() *http.Client {
+	if ds.Client != nil {
+		return ds.Client
+	}
+	return httpclient.Default()
 }
 
 func (ds *DNS01Setting) NewDNS01() (DNS01, error) {
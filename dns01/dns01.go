@@ -12,3 +12,5 @@ var FromFile = common.FromFile
 type DNS01Setting struct {
 	common.DNS01Setting
 }
+
+type DNS01 = common.DNS01
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/nicennnnnnnlee/cert_bot/dns01/common"
+	"github.com/nicennnnnnnlee/cert_bot/httpclient"
 )
 
 func init() {
@@ -26,12 +27,22 @@ func option(ds *common.DNS01Setting) (common.DNS01, error) {
 	if err != nil {
 		return nil, fmt.Errorf("dns config of '%s' is not valid: %v", ds.Type, err)
 	}
+	dns01.client = ds.HTTPClient()
 	return &dns01, nil
 }
 
 type HE struct {
 	Domain   string `json:"domain"`
 	Password string `json:"password"`
+
+	client *http.Client
+}
+
+func (he *HE) httpClient() *http.Client {
+	if he.client != nil {
+		return he.client
+	}
+	return httpclient.Default()
 }
 
 func (n *HE) UnmarshalJSON(data []byte) error {
@@ -66,7 +77,7 @@ func (he *HE) SetTXT(txt string) (err error) {
 		return fmt.Errorf("he.net: error creating request: %v", err)
 	}
 	// req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	c := &http.Client{Timeout: 10 * time.Second}
+	c := he.httpClient()
 	resp, err := c.Do(req)
 	if err != nil {
 		return fmt.Errorf("he.net: error sending request: %v", err)
@@ -0,0 +1,282 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTypeCAA   = 257
+	dnsClassINET = 1
+	dnsTimeout   = 5 * time.Second
+)
+
+// CAARecord is a CAA resource record, see RFC 8659
+type CAARecord struct {
+	Flag  uint8  `json:"flag"`
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+}
+
+func (rec CAARecord) String() string {
+	return fmt.Sprintf("%d %s %q", rec.Flag, rec.Tag, rec.Value)
+}
+
+// critical reports whether the issuer critical flag is set
+func (rec CAARecord) critical() bool {
+	return rec.Flag&0x80 != 0
+}
+
+var knownCAATags = map[string]bool{
+	"issue": true, "issuewild": true, "iodef": true, "issuemail": true,
+	"issuevmc": true, "contactemail": true, "contactphone": true,
+}
+
+// LookupCAA queries the CAA records of name on dnsServer (host:port).
+// A name without records (or that does not exist) returns no records and no error.
+func LookupCAA(dnsServer string, name string) ([]CAARecord, error) {
+	query, id, err := caaQuery(name)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := exchangeUDP(dnsServer, query)
+	if err == nil && len(rsp) > 2 && rsp[2]&0x02 != 0 {
+		// truncated, retry over tcp
+		rsp, err = exchangeTCP(dnsServer, query)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying CAA of %s: %v", name, err)
+	}
+	return parseCAAResponse(rsp, id)
+}
+
+// LookupCAASet climbs the tree from name until a non-empty CAA record set is found, see RFC 8659 section 3.
+// It returns the records and the domain they were found at.
+func LookupCAASet(dnsServer string, name string) ([]CAARecord, string, error) {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "*."), ".")
+	for name != "" {
+		records, err := LookupCAA(dnsServer, name)
+		if err != nil {
+			return nil, name, err
+		}
+		if len(records) > 0 {
+			return records, name, nil
+		}
+		_, parent, _ := strings.Cut(name, ".")
+		name = parent
+	}
+	return nil, "", nil
+}
+
+func caaQuery(name string) ([]byte, uint16, error) {
+	id := uint16(rand.Intn(1 << 16))
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	// recursion desired
+	msg[2] = 0x01
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, fmt.Errorf("invalid domain name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeCAA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassINET)
+	return msg, id, nil
+}
+
+func exchangeUDP(dnsServer string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", dnsServer, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func exchangeTCP(dnsServer string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", dnsServer, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(query)))); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func parseCAAResponse(msg []byte, id uint16) ([]CAARecord, error) {
+	if len(msg) < 12 {
+		return nil, fmt.Errorf("dns response too short")
+	}
+	if binary.BigEndian.Uint16(msg[0:]) != id {
+		return nil, fmt.Errorf("dns response id mismatch")
+	}
+	switch rcode := msg[3] & 0x0f; rcode {
+	case 0:
+	case 3:
+		// NXDOMAIN, the name has no records
+		return nil, nil
+	default:
+		// CAs refuse to issue when the CAA lookup fails, e.g. SERVFAIL
+		return nil, fmt.Errorf("dns response code %d", rcode)
+	}
+	qdCount := binary.BigEndian.Uint16(msg[4:])
+	anCount := binary.BigEndian.Uint16(msg[6:])
+	off := 12
+	var err error
+	for i := 0; i < int(qdCount); i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+	var records []CAARecord
+	for i := 0; i < int(anCount); i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, fmt.Errorf("dns response truncated")
+		}
+		rrType := binary.BigEndian.Uint16(msg[off:])
+		rdLen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdLen > len(msg) {
+			return nil, fmt.Errorf("dns response truncated")
+		}
+		rdata := msg[off : off+rdLen]
+		off += rdLen
+		if rrType != dnsTypeCAA {
+			continue
+		}
+		if len(rdata) < 2 || 2+int(rdata[1]) > len(rdata) {
+			return nil, fmt.Errorf("malformed CAA record")
+		}
+		tagLen := int(rdata[1])
+		records = append(records, CAARecord{
+			Flag:  rdata[0],
+			Tag:   strings.ToLower(string(rdata[2 : 2+tagLen])),
+			Value: string(rdata[2+tagLen:]),
+		})
+	}
+	return records, nil
+}
+
+// skipName returns the offset after the (possibly compressed) name at off
+func skipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, fmt.Errorf("dns response truncated")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			// a pointer ends the name
+			return off + 2, nil
+		default:
+			off += 1 + l
+		}
+	}
+}
+
+// ParseCAAValue parses the value of an issue or issuewild property into the issuer domain and its parameters
+func ParseCAAValue(value string) (string, map[string]string) {
+	parts := strings.Split(value, ";")
+	domain := strings.ToLower(strings.TrimSpace(parts[0]))
+	params := make(map[string]string)
+	for _, part := range parts[1:] {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		params[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+	}
+	return domain, params
+}
+
+// CAAAllows checks whether records allow a CA known by caIdentities to issue for a name,
+// using account accountURI and challenge method. It returns the reason of the decision.
+func CAAAllows(records []CAARecord, wildcard bool, caIdentities []string, accountURI string, method string) (bool, string) {
+	var issue, issuewild []CAARecord
+	for _, rec := range records {
+		switch rec.Tag {
+		case "issue":
+			issue = append(issue, rec)
+		case "issuewild":
+			issuewild = append(issuewild, rec)
+		default:
+			if rec.critical() && !knownCAATags[rec.Tag] {
+				return false, fmt.Sprintf("unknown critical property %s", rec)
+			}
+		}
+	}
+	property := issue
+	if wildcard && len(issuewild) > 0 {
+		property = issuewild
+	}
+	if len(property) == 0 {
+		return true, "no issue property, any CA may issue"
+	}
+	if len(caIdentities) == 0 {
+		return true, "the CA publishes no caaIdentities, CAA not verified"
+	}
+	reason := fmt.Sprintf("CA %s is not allowed", strings.Join(caIdentities, ","))
+	for _, rec := range property {
+		domain, params := ParseCAAValue(rec.Value)
+		if !containsFold(caIdentities, domain) {
+			continue
+		}
+		if uri, ok := params["accounturi"]; ok && uri != accountURI {
+			reason = fmt.Sprintf("%s requires account %s", rec, uri)
+			continue
+		}
+		if methods, ok := params["validationmethods"]; ok && !containsFold(strings.Split(methods, ","), method) {
+			reason = fmt.Sprintf("%s does not allow %s", rec, method)
+			continue
+		}
+		return true, fmt.Sprintf("allowed by %s", rec)
+	}
+	return false, reason
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(strings.TrimSpace(v), s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package engine_test
+
+import (
+	"testing"
+
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+// go test ./engine -v -run TestCAAAllows
+func TestCAAAllows(t *testing.T) {
+	le := []string{"letsencrypt.org"}
+	account := "https://acme-v02.api.letsencrypt.org/acme/acct/1"
+	records := []engine.CAARecord{
+		{Tag: "issue", Value: "letsencrypt.org; accounturi=" + account + "; validationmethods=dns-01"},
+		{Tag: "issuewild", Value: ";"},
+		{Tag: "iodef", Value: "mailto:admin@example.com"},
+	}
+	cases := []struct {
+		name     string
+		records  []engine.CAARecord
+		wildcard bool
+		ca       []string
+		account  string
+		method   string
+		want     bool
+	}{
+		{"allowed", records, false, le, account, "dns-01", true},
+		{"other account", records, false, le, account + "2", "dns-01", false},
+		{"other method", records, false, le, account, "http-01", false},
+		{"other ca", records, false, []string{"sectigo.com"}, account, "dns-01", false},
+		{"wildcard forbidden", records, true, le, account, "dns-01", false},
+		{"no issue property", records[2:], false, le, "", "http-01", true},
+		{"unknown critical", []engine.CAARecord{{Flag: 128, Tag: "future", Value: "x"}}, false, le, "", "dns-01", false},
+	}
+	for _, c := range cases {
+		if ok, reason := engine.CAAAllows(c.records, c.wildcard, c.ca, c.account, c.method); ok != c.want {
+			t.Errorf("%s: expected %v, got %v (%s)", c.name, c.want, ok, reason)
+		}
+	}
+}
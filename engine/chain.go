@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"crypto/x509"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/eggsampler/acme/v3"
+)
+
+// FetchCertificates fetches the certificate chain of a finalized order.
+// If preferredChain is not empty, the alternate chains linked by `Link: rel=alternate` are fetched too,
+// and the first chain issued by the preferred root is returned. The default chain is used if none matches,
+// or if an alternate chain can't be fetched: the certificate is already issued and must not be lost.
+func FetchCertificates(client acme.Client, account acme.Account, certificateUrl string, preferredChain string) ([]*x509.Certificate, error) {
+	if preferredChain == "" {
+		return client.FetchCertificates(account, certificateUrl)
+	}
+	chains, err := client.FetchAllCertificates(account, certificateUrl)
+	if err != nil {
+		log.Printf("Preferred chain %q not found, error fetching the alternate chains of %s: %v\n", preferredChain, certificateUrl, err)
+		return client.FetchCertificates(account, certificateUrl)
+	}
+	chain := SelectChain(chains, certificateUrl, preferredChain)
+	if !strings.EqualFold(ChainIssuer(chain), preferredChain) {
+		log.Printf("Preferred chain %q not found for %s, using the default chain issued by %q\n", preferredChain, certificateUrl, ChainIssuer(chain))
+	}
+	return chain, nil
+}
+
+// SelectChain returns the chain whose topmost certificate is issued by the preferredChain common name,
+// the chain of defaultUrl otherwise. Like certbot and lego, the subject of the topmost certificate is not matched:
+// a cross-signed root like "ISRG Root X1" by "DST Root CA X3" would select the chain that was not asked for.
+func SelectChain(chains map[string][]*x509.Certificate, defaultUrl string, preferredChain string) []*x509.Certificate {
+	// the default chain goes first, the alternates keep a stable order
+	urls := []string{defaultUrl}
+	var alternates []string
+	for u := range chains {
+		if u != defaultUrl {
+			alternates = append(alternates, u)
+		}
+	}
+	sort.Strings(alternates)
+	urls = append(urls, alternates...)
+
+	for _, u := range urls {
+		chain := chains[u]
+		if len(chain) == 0 {
+			continue
+		}
+		top := chain[len(chain)-1]
+		if strings.EqualFold(top.Issuer.CommonName, preferredChain) {
+			return chain
+		}
+	}
+	return chains[defaultUrl]
+}
+
+// ChainIssuer is the common name of the root the chain is issued by, used for logging.
+func ChainIssuer(chain []*x509.Certificate) string {
+	if len(chain) == 0 {
+		return ""
+	}
+	return chain[len(chain)-1].Issuer.CommonName
+}
@@ -0,0 +1,42 @@
+package engine_test
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+func chainOf(issuers ...string) []*x509.Certificate {
+	var chain []*x509.Certificate
+	for _, issuer := range issuers {
+		chain = append(chain, &x509.Certificate{Issuer: pkix.Name{CommonName: issuer}})
+	}
+	return chain
+}
+
+// go test ./engine -v -run TestSelectChain
+func TestSelectChain(t *testing.T) {
+	chains := map[string][]*x509.Certificate{
+		"https://ca/cert/1":   chainOf("R3", "DST Root CA X3"),
+		"https://ca/cert/1/1": chainOf("R3", "ISRG Root X1"),
+	}
+	if chain := engine.SelectChain(chains, "https://ca/cert/1", "isrg root x1"); engine.ChainIssuer(chain) != "ISRG Root X1" {
+		t.Fatalf("expected alternate chain, got %s", engine.ChainIssuer(chain))
+	}
+	if chain := engine.SelectChain(chains, "https://ca/cert/1", "Unknown Root"); engine.ChainIssuer(chain) != "DST Root CA X3" {
+		t.Fatalf("expected default chain, got %s", engine.ChainIssuer(chain))
+	}
+
+	// the long chain ends with "ISRG Root X1" cross-signed by "DST Root CA X3", it must not match "ISRG Root X1"
+	crossSigned := chainOf("R3", "DST Root CA X3")
+	crossSigned[1].Subject = pkix.Name{CommonName: "ISRG Root X1"}
+	chains = map[string][]*x509.Certificate{
+		"https://ca/cert/1":   crossSigned,
+		"https://ca/cert/1/1": chainOf("R3", "ISRG Root X1"),
+	}
+	if chain := engine.SelectChain(chains, "https://ca/cert/1", "ISRG Root X1"); len(chain) == 0 || chain[1].Subject.CommonName != "" {
+		t.Fatalf("expected the chain issued by ISRG Root X1, got the one issued by %s", engine.ChainIssuer(chain))
+	}
+}
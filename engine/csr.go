@@ -0,0 +1,160 @@
+package engine
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/eggsampler/acme/v3"
+)
+
+// ParseCSR parses a pem (or der) encoded certificate request and checks its signature
+func ParseCSR(data []byte) (*x509.CertificateRequest, error) {
+	if b, _ := pem.Decode(data); b != nil {
+		if b.Type != "CERTIFICATE REQUEST" && b.Type != "NEW CERTIFICATE REQUEST" {
+			return nil, fmt.Errorf("unexpected pem type %q, want CERTIFICATE REQUEST", b.Type)
+		}
+		data = b.Bytes
+	}
+	csr, err := x509.ParseCertificateRequest(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate request: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request signature: %v", err)
+	}
+	if len(csr.DNSNames) == 0 && len(csr.IPAddresses) == 0 {
+		return nil, fmt.Errorf("certificate request has no dns or ip subject alternative names")
+	}
+	return csr, nil
+}
+
+// LoadCSR reads and parses the certificate request file
+func LoadCSR(csrFile string) (*x509.CertificateRequest, error) {
+	raw, err := os.ReadFile(csrFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading csr file %q: %v", csrFile, err)
+	}
+	return ParseCSR(raw)
+}
+
+// CSRIdentifiers returns the acme identifiers of the subject alternative names of the csr
+func CSRIdentifiers(csr *x509.CertificateRequest) []acme.Identifier {
+	var ids []acme.Identifier
+	for _, name := range csr.DNSNames {
+		ids = append(ids, acme.Identifier{Type: "dns", Value: name})
+	}
+	for _, ip := range csr.IPAddresses {
+		ids = append(ids, acme.Identifier{Type: "ip", Value: ip.String()})
+	}
+	return ids
+}
+
+// IdentifierValues returns the values of ids, for logging
+func IdentifierValues(ids []acme.Identifier) []string {
+	var values []string
+	for _, id := range ids {
+		values = append(values, id.Value)
+	}
+	return values
+}
+
+var oidTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// mustStapleValue is the TLS feature extension value requesting status_request (5), see RFC 7633
+var mustStapleValue = []byte{0x30, 0x03, 0x02, 0x01, 0x05}
+
+// CSROptions customizes the csr the certificate is requested with
+type CSROptions struct {
+	// CommonName of the subject, it must be one of the identifiers. Defaults to the first domain
+	CommonName string `json:"commonName,omitempty"`
+	// NoCommonName leaves the common name empty, for SAN-only certificates
+	NoCommonName bool `json:"noCommonName,omitempty"`
+	// MustStaple requests the OCSP must-staple (TLS feature) extension
+	MustStaple bool `json:"mustStaple,omitempty"`
+	// the other subject fields, most CAs only keep them for OV/EV certificates
+	Organization       string `json:"organization,omitempty"`
+	OrganizationalUnit string `json:"organizationalUnit,omitempty"`
+	Country            string `json:"country,omitempty"`
+	Province           string `json:"province,omitempty"`
+	Locality           string `json:"locality,omitempty"`
+}
+
+func (opts CSROptions) commonName(ids []acme.Identifier) (string, error) {
+	if opts.NoCommonName {
+		return "", nil
+	}
+	if opts.CommonName == "" {
+		if names := DNSNames(ids); len(names) > 0 {
+			return names[0], nil
+		}
+		return "", nil
+	}
+	for _, id := range ids {
+		if strings.EqualFold(id.Value, opts.CommonName) {
+			return opts.CommonName, nil
+		}
+	}
+	return "", fmt.Errorf("common name %q is not one of the identifiers", opts.CommonName)
+}
+
+func nameOf(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+// CreateCSR creates the csr of ids signed by key
+func CreateCSR(key crypto.Signer, ids []acme.Identifier, opts CSROptions) (*x509.CertificateRequest, error) {
+	cn, err := opts.commonName(ids)
+	if err != nil {
+		return nil, err
+	}
+	tpl := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:         cn,
+			Organization:       nameOf(opts.Organization),
+			OrganizationalUnit: nameOf(opts.OrganizationalUnit),
+			Country:            nameOf(opts.Country),
+			Province:           nameOf(opts.Province),
+			Locality:           nameOf(opts.Locality),
+		},
+		DNSNames:    DNSNames(ids),
+		IPAddresses: IPAddresses(ids),
+	}
+	if opts.MustStaple {
+		tpl.ExtraExtensions = append(tpl.ExtraExtensions, pkix.Extension{Id: oidTLSFeature, Value: mustStapleValue})
+	}
+	csrDer, err := x509.CreateCertificateRequest(rand.Reader, tpl, key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating certificate request: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDer)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate request: %v", err)
+	}
+	return csr, nil
+}
+
+// ParseOrderTime parses the notBefore/notAfter of an order, either a RFC 3339 time or a duration from now like "168h"
+func ParseOrderTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a RFC 3339 time nor a duration", s)
+	}
+	return now.Add(d), nil
+}
@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WriteCertificate writes the pem encoded chain to certPath and keyPem to keyPath, if not nil.
+// Both are written to temporary files first and renamed only when both writes succeeded,
+// so that a failure never leaves a new certificate next to the old key.
+// The key is renamed first, when the certificate can't be renamed the old key is put back.
+func WriteCertificate(certPath string, certs []*x509.Certificate, keyPath string, keyPem []byte) error {
+	var pemData []string
+	for _, c := range certs {
+		pemData = append(pemData, strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: c.Raw,
+		}))))
+	}
+	certTmp, err := writeTemp(certPath, []byte(strings.Join(pemData, "\n")))
+	if err != nil {
+		return fmt.Errorf("error writing certificate file %q: %v", certPath, err)
+	}
+	defer os.Remove(certTmp)
+	// the old key is kept until the certificate is renamed too, so that it can be put back
+	restoreKey := func() {}
+	if keyPem != nil {
+		keyTmp, err := writeTemp(keyPath, keyPem)
+		if err != nil {
+			return fmt.Errorf("error writing key file %q: %v", keyPath, err)
+		}
+		defer os.Remove(keyTmp)
+		backup := keyPath + ".old"
+		hadKey := true
+		if err := os.Rename(keyPath, backup); os.IsNotExist(err) {
+			hadKey = false
+		} else if err != nil {
+			return fmt.Errorf("error writing key file %q: %v", keyPath, err)
+		}
+		restoreKey = func() {
+			if hadKey {
+				os.Rename(backup, keyPath)
+			} else {
+				os.Remove(keyPath)
+			}
+		}
+		if err := os.Rename(keyTmp, keyPath); err != nil {
+			restoreKey()
+			return fmt.Errorf("error writing key file %q: %v", keyPath, err)
+		}
+		if hadKey {
+			defer os.Remove(backup)
+		}
+	}
+	if err := os.Rename(certTmp, certPath); err != nil {
+		restoreKey()
+		return fmt.Errorf("error writing certificate file %q: %v", certPath, err)
+	}
+	return nil
+}
+
+// writeTemp writes data to a new temporary file next to path, so that it can be renamed over path
+func writeTemp(path string, data []byte) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
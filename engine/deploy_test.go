@@ -0,0 +1,66 @@
+package engine_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eggsampler/acme/v3"
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+// go test ./engine -v -run TestWriteCertificate
+func TestWriteCertificate(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, nil, &key.PublicKey, key)
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := engine.WriteCertificate(certPath, []*x509.Certificate{cert}, keyPath, []byte("new key")); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := os.ReadFile(keyPath); string(raw) != "new key" {
+		t.Fatalf("unexpected key file %q", raw)
+	}
+
+	// the key can not be written, the certificate stays untouched
+	os.WriteFile(certPath, []byte("old cert"), 0600)
+	err := engine.WriteCertificate(certPath, []*x509.Certificate{cert}, filepath.Join(dir, "missing", "key.pem"), []byte("new key"))
+	if err == nil {
+		t.Fatal("expected an error writing the key")
+	}
+	if raw, _ := os.ReadFile(certPath); string(raw) != "old cert" {
+		t.Fatalf("certificate was replaced: %q", raw)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Fatalf("temporary files left: %v", entries)
+	}
+
+	// the certificate can not be renamed over a directory, the old key is put back
+	os.WriteFile(keyPath, []byte("old key"), 0600)
+	dirCert := filepath.Join(dir, "cert-dir")
+	os.MkdirAll(filepath.Join(dirCert, "x"), 0700)
+	if err := engine.WriteCertificate(dirCert, []*x509.Certificate{cert}, keyPath, []byte("new key")); err == nil {
+		t.Fatal("expected an error renaming the certificate")
+	}
+	if raw, _ := os.ReadFile(keyPath); string(raw) != "old key" {
+		t.Fatalf("the old key was not restored: %q", raw)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 3 {
+		t.Fatalf("temporary files left: %v", entries)
+	}
+
+	if _, err := engine.RootsFor(acme.LetsEncryptStaging, ""); err == nil {
+		t.Fatal("expected an error for the staging CA without roots")
+	}
+}
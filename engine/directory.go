@@ -0,0 +1,105 @@
+package engine
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/eggsampler/acme/v3"
+)
+
+// DirectoryPresets are the short CA names that can be used in place of an acme directory url.
+var DirectoryPresets = map[string]string{
+	"letsencrypt":         acme.LetsEncryptProduction,
+	"letsencrypt-staging": acme.LetsEncryptStaging,
+	"zerossl":             acme.ZeroSSLProduction,
+	"buypass":             "https://api.buypass.com/acme/directory",
+	"google":              "https://dv.acme-v02.api.pki.goog/directory",
+}
+
+// DefaultDirectoryUrl is used when no directory url is configured.
+const DefaultDirectoryUrl = acme.LetsEncryptProduction
+
+// ResolveDirectoryUrl returns the directory url of a preset name, or the input itself if it is not a preset.
+func ResolveDirectoryUrl(nameOrUrl string) string {
+	nameOrUrl = strings.TrimSpace(nameOrUrl)
+	if u, ok := DirectoryPresets[strings.ToLower(nameOrUrl)]; ok {
+		return u
+	}
+	return nameOrUrl
+}
+
+// DirectoryUrls resolves every entry of the ordered CA list, dropping empty entries and duplicates.
+// The list defaults to DefaultDirectoryUrl if nothing is left.
+func DirectoryUrls(namesOrUrls ...string) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	for _, s := range namesOrUrls {
+		u := ResolveDirectoryUrl(s)
+		if u == "" || seen[u] {
+			continue
+		}
+		seen[u] = true
+		urls = append(urls, u)
+	}
+	if len(urls) == 0 {
+		urls = append(urls, DefaultDirectoryUrl)
+	}
+	return urls
+}
+
+// PresetName returns the preset name of a directory url, or "" if the url is not a preset.
+func PresetName(directoryUrl string) string {
+	for name, u := range DirectoryPresets {
+		if u == directoryUrl {
+			return name
+		}
+	}
+	return ""
+}
+
+type failoverError struct {
+	err error
+}
+
+func (e *failoverError) Error() string { return e.err.Error() }
+func (e *failoverError) Unwrap() error { return e.err }
+
+// Failover marks err as a failure of the CA itself, so that the next CA in the list is tried.
+func Failover(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &failoverError{err}
+}
+
+// IsFailoverError reports whether the order should be retried with the next CA:
+// the CA is unreachable, rate-limits us or answers with a server error.
+func IsFailoverError(err error) bool {
+	var fe *failoverError
+	if errors.As(err, &fe) {
+		return true
+	}
+	prob, ok := AsProblem(err)
+	if !ok {
+		return false
+	}
+	switch prob.Type {
+	case "urn:ietf:params:acme:error:rateLimited", "urn:ietf:params:acme:error:serverInternal":
+		return true
+	}
+	return prob.Status == http.StatusTooManyRequests || prob.Status >= http.StatusInternalServerError
+}
+
+// AsProblem finds the acme problem document in the error chain.
+func AsProblem(err error) (acme.Problem, bool) {
+	var prob acme.Problem
+	if errors.As(err, &prob) {
+		return prob, true
+	}
+	var pProb *acme.Problem
+	if errors.As(err, &pProb) && pProb != nil {
+		return *pProb, true
+	}
+	return acme.Problem{}, false
+}
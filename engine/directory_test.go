@@ -0,0 +1,36 @@
+package engine_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/eggsampler/acme/v3"
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+// go test ./engine -v -run TestDirectoryUrls
+func TestDirectoryUrls(t *testing.T) {
+	urls := engine.DirectoryUrls("", " ZeroSSL", "https://ca.internal/acme/directory", "zerossl")
+	if len(urls) != 2 || urls[0] != acme.ZeroSSLProduction || urls[1] != "https://ca.internal/acme/directory" {
+		t.Fatalf("unexpected directory urls: %v", urls)
+	}
+	if urls := engine.DirectoryUrls(); len(urls) != 1 || urls[0] != engine.DefaultDirectoryUrl {
+		t.Fatalf("unexpected default directory urls: %v", urls)
+	}
+}
+
+// go test ./engine -v -run TestIsFailoverError
+func TestIsFailoverError(t *testing.T) {
+	rateLimited := fmt.Errorf("error creating new order: %w", acme.Problem{Type: "urn:ietf:params:acme:error:rateLimited", Status: 429})
+	if !engine.IsFailoverError(rateLimited) {
+		t.Fatal("rateLimited should fail over")
+	}
+	unauthorized := fmt.Errorf("error finalizing order: %w", acme.Problem{Type: "urn:ietf:params:acme:error:unauthorized", Status: 403})
+	if engine.IsFailoverError(unauthorized) {
+		t.Fatal("unauthorized should not fail over")
+	}
+	if !engine.IsFailoverError(engine.Failover(errors.New("connection refused"))) {
+		t.Fatal("marked error should fail over")
+	}
+}
@@ -0,0 +1,139 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/eggsampler/acme/v3"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// DomainList is a normalized, deduplicated list of domains and ip addresses.
+// Domains are lowercased, IDNs converted to punycode and trailing dots removed.
+type DomainList []string
+
+// DomainError is an invalid entry of a domain list
+type DomainError struct {
+	Domain string `json:"domain"`
+	Reason string `json:"reason"`
+}
+
+// DomainListError lists every invalid entry of a domain list
+type DomainListError struct {
+	Entries []DomainError
+}
+
+func (e *DomainListError) Error() string {
+	var msgs []string
+	for _, entry := range e.Entries {
+		msgs = append(msgs, fmt.Sprintf("%q: %s", entry.Domain, entry.Reason))
+	}
+	return "invalid domains: " + strings.Join(msgs, "; ")
+}
+
+// ParseDomainList parses a comma separated list of domains, empty entries are skipped.
+// The error is a *DomainListError with the reason of every invalid entry.
+func ParseDomainList(s string) (DomainList, error) {
+	var list DomainList
+	var errs []DomainError
+	seen := make(map[string]bool)
+	for _, raw := range strings.Split(s, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		name, err := NormalizeDomain(raw)
+		if err != nil {
+			errs = append(errs, DomainError{Domain: raw, Reason: err.Error()})
+			continue
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		list = append(list, name)
+	}
+	if len(errs) > 0 {
+		return nil, &DomainListError{Entries: errs}
+	}
+	if len(list) == 0 {
+		return nil, &DomainListError{Entries: []DomainError{{Domain: s, Reason: "no domain provided"}}}
+	}
+	return list, nil
+}
+
+// NormalizeDomain validates a single domain (or ip address) and returns its canonical form
+func NormalizeDomain(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if ip := net.ParseIP(strings.Trim(name, "[]")); ip != nil {
+		return ip.String(), nil
+	}
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return "", fmt.Errorf("empty domain")
+	}
+	wildcard := false
+	if rest, ok := strings.CutPrefix(name, "*."); ok {
+		wildcard = true
+		name = rest
+	}
+	if strings.Contains(name, "*") {
+		return "", fmt.Errorf("wildcard must be the leftmost label")
+	}
+	// UTS-46 mapping lowercases, normalizes and maps ideographic full stops before punycode conversion
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain: %v", err)
+	}
+	name = strings.TrimSuffix(ascii, ".")
+	if name == "" {
+		return "", fmt.Errorf("empty domain")
+	}
+	labels := strings.Split(name, ".")
+	for _, label := range labels {
+		if err := checkLabel(label); err != nil {
+			return "", err
+		}
+	}
+	if wildcard {
+		// e.g. *.co.uk or *.github.io would cover the domains of many owners
+		if suffix, _ := publicsuffix.PublicSuffix(name); suffix == name {
+			return "", fmt.Errorf("wildcard needs a registered domain below it")
+		}
+		labels = append([]string{"*"}, labels...)
+	}
+	name = strings.Join(labels, ".")
+	if len(name) > 253 {
+		return "", fmt.Errorf("domain is longer than 253 characters")
+	}
+	return name, nil
+}
+
+func checkLabel(label string) error {
+	if label == "" {
+		return fmt.Errorf("empty label")
+	}
+	if len(label) > 63 {
+		return fmt.Errorf("label %q is longer than 63 characters", label)
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return fmt.Errorf("label %q starts or ends with a hyphen", label)
+	}
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return fmt.Errorf("label %q contains invalid character %q", label, c)
+		}
+	}
+	return nil
+}
+
+func (list DomainList) String() string {
+	return strings.Join(list, ",")
+}
+
+// Identifiers returns the acme identifiers of the list
+func (list DomainList) Identifiers() []acme.Identifier {
+	return Identifiers(list)
+}
@@ -0,0 +1,35 @@
+package engine_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+// go test ./engine -v -run TestParseDomainList
+func TestParseDomainList(t *testing.T) {
+	list, err := engine.ParseDomainList(" Example.COM., *.example.com,,example.com, bücher.example, 中文。com, 192.0.2.1, ＥＸＡＭＰＬＥ．org, *.example.co.uk, *.me.github.io ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "example.com,*.example.com,xn--bcher-kva.example,xn--fiq228c.com,192.0.2.1,example.org,*.example.co.uk,*.me.github.io"
+	if list.String() != want {
+		t.Fatalf("expected %s, got %s", want, list)
+	}
+}
+
+// go test ./engine -v -run TestParseDomainListErrors
+func TestParseDomainListErrors(t *testing.T) {
+	_, err := engine.ParseDomainList("a.*.example.com,*.com,-a.example.com,a_b.example.com,*.co.uk,*.github.io,*.com.br,*.herokuapp.com,*.co.id,ok.example.com")
+	var listErr *engine.DomainListError
+	if !errors.As(err, &listErr) {
+		t.Fatalf("expected DomainListError, got %v", err)
+	}
+	if len(listErr.Entries) != 9 {
+		t.Fatalf("expected 9 invalid entries, got %v", listErr.Entries)
+	}
+	if _, err := engine.ParseDomainList(" , "); err == nil {
+		t.Fatal("empty list should be rejected")
+	}
+}
@@ -0,0 +1,220 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eggsampler/acme/v3"
+)
+
+const problemPrefix = "urn:ietf:params:acme:error:"
+
+// classes of acme errors, the suffix of the problem type or connection for network failures
+const (
+	ClassRateLimited    = "rateLimited"
+	ClassBadNonce       = "badNonce"
+	ClassServerInternal = "serverInternal"
+	ClassUnauthorized   = "unauthorized"
+	ClassDNS            = "dns"
+	ClassConnection     = "connection"
+)
+
+// ProblemInfo is the classified problem of an error, as exposed in api results
+type ProblemInfo struct {
+	Class       string            `json:"class,omitempty"`
+	Type        string            `json:"type,omitempty"`
+	Detail      string            `json:"detail,omitempty"`
+	Status      int               `json:"status,omitempty"`
+	SubProblems []acme.SubProblem `json:"subproblems,omitempty"`
+}
+
+// retryAfterError carries the Retry-After of the response an error came from
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// withRetryAfter attaches the Retry-After header of rsp to err
+func withRetryAfter(err error, rsp *http.Response) error {
+	if after, ok := parseRetryAfter(rsp.Header.Get("Retry-After"), time.Now()); ok {
+		return &retryAfterError{err: err, after: after}
+	}
+	return err
+}
+
+// RetryAfterRecorder is the transport of an acme client that remembers the Retry-After of the last response.
+// The errors of the acme library drop the response headers, Attach adds it back.
+// A recorder is meant for one issuance at a time, whose calls to the CA are sequential.
+type RetryAfterRecorder struct {
+	next  http.RoundTripper
+	mu    sync.Mutex
+	after time.Duration
+	ok    bool
+}
+
+// RecordRetryAfter returns a copy of httpClient (the default client if nil) whose responses are seen by the returned recorder
+func RecordRetryAfter(httpClient *http.Client) (*http.Client, *RetryAfterRecorder) {
+	c := *clientOrDefault(httpClient)
+	rec := &RetryAfterRecorder{next: c.Transport}
+	if rec.next == nil {
+		rec.next = http.DefaultTransport
+	}
+	c.Transport = rec
+	return &c, rec
+}
+
+func (rec *RetryAfterRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	rsp, err := rec.next.RoundTrip(req)
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.after, rec.ok = 0, false
+	if err == nil && rsp.StatusCode >= 400 {
+		rec.after, rec.ok = parseRetryAfter(rsp.Header.Get("Retry-After"), time.Now())
+	}
+	return rsp, err
+}
+
+// Attach attaches the Retry-After of the last response to err, the error of the last call to the CA
+func (rec *RetryAfterRecorder) Attach(err error) error {
+	if err == nil || rec == nil {
+		return err
+	}
+	if _, ok := RetryAfter(err); ok {
+		return err
+	}
+	rec.mu.Lock()
+	after, ok := rec.after, rec.ok
+	rec.mu.Unlock()
+	if !ok {
+		return err
+	}
+	return &retryAfterError{err: err, after: after}
+}
+
+// parseRetryAfter parses a Retry-After header, either seconds or a http date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// RetryAfter returns the Retry-After the CA sent with err, if any
+func RetryAfter(err error) (time.Duration, bool) {
+	var ra *retryAfterError
+	if errors.As(err, &ra) {
+		return ra.after, true
+	}
+	return 0, false
+}
+
+// Classify returns the class of err: the problem type without its acme prefix,
+// connection for network failures, or "" for other errors.
+func Classify(err error) string {
+	if err == nil {
+		return ""
+	}
+	if prob, ok := AsProblem(err); ok && prob.Type != "" {
+		return strings.TrimPrefix(prob.Type, problemPrefix)
+	}
+	var netErr net.Error
+	var urlErr *url.Error
+	if errors.As(err, &netErr) || errors.As(err, &urlErr) {
+		return ClassConnection
+	}
+	return ""
+}
+
+// Problem returns the classified problem of err, nil when err is nil
+func Problem(err error) *ProblemInfo {
+	if err == nil {
+		return nil
+	}
+	info := &ProblemInfo{Class: Classify(err), Detail: err.Error()}
+	if prob, ok := AsProblem(err); ok {
+		info.Type = prob.Type
+		info.Status = prob.Status
+		info.SubProblems = prob.SubProblems
+	}
+	return info
+}
+
+// IsTransient reports whether an operation that failed with err may succeed when retried
+func IsTransient(err error) bool {
+	switch Classify(err) {
+	case ClassBadNonce, ClassServerInternal, ClassConnection:
+		return true
+	case ClassRateLimited:
+		// only worth waiting for when the CA tells how long
+		_, ok := RetryAfter(err)
+		return ok
+	}
+	prob, ok := AsProblem(err)
+	return ok && prob.Status >= http.StatusInternalServerError
+}
+
+// RetryPolicy is the exponential backoff of Retry
+type RetryPolicy struct {
+	Attempts int
+	Base     time.Duration
+	Max      time.Duration
+}
+
+// DefaultRetryPolicy tries 4 times, waiting 2s, 4s and 8s in between unless the CA asks for longer
+var DefaultRetryPolicy = RetryPolicy{Attempts: 4, Base: 2 * time.Second, Max: 2 * time.Minute}
+
+// delay returns the wait before the attempt after the n-th (from 0) failed one
+func (p RetryPolicy) delay(n int, err error) (time.Duration, bool) {
+	d := p.Base << n
+	if after, ok := RetryAfter(err); ok && after > d {
+		d = after
+	}
+	if d > p.Max {
+		return 0, false
+	}
+	return d, true
+}
+
+// Retry runs fn until it succeeds, fails with an error that is not transient or the attempts are exhausted.
+// Waits honor the Retry-After of the CA; a wait longer than Max is not attempted.
+// The last error is returned wrapped with op.
+func Retry(op string, policy RetryPolicy, logf func(format string, a ...any), fn func() error) error {
+	var err error
+	for n := 0; ; n++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if n+1 >= policy.Attempts || !IsTransient(err) {
+			break
+		}
+		d, ok := policy.delay(n, err)
+		if !ok {
+			break
+		}
+		if logf != nil {
+			logf("error %s (%s), retrying in %s: %v", op, Classify(err), d, err)
+		}
+		time.Sleep(d)
+	}
+	return fmt.Errorf("error %s: %w", op, err)
+}
@@ -0,0 +1,82 @@
+package engine_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/eggsampler/acme/v3"
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+// go test ./engine -v -run TestRetry
+func TestRetry(t *testing.T) {
+	policy := engine.RetryPolicy{Attempts: 3, Base: time.Millisecond, Max: time.Second}
+	calls := 0
+	err := engine.Retry("finalizing order", policy, nil, func() error {
+		calls++
+		if calls < 3 {
+			return acme.Problem{Type: "urn:ietf:params:acme:error:badNonce", Status: http.StatusBadRequest}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("expected success on the third attempt, got %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	unauthorized := acme.Problem{
+		Type:        "urn:ietf:params:acme:error:unauthorized",
+		Status:      http.StatusForbidden,
+		SubProblems: []acme.SubProblem{{Type: "urn:ietf:params:acme:error:dns", Identifier: acme.Identifier{Type: "dns", Value: "a.example.com"}}},
+	}
+	err = engine.Retry("creating new order", policy, nil, func() error {
+		calls++
+		return unauthorized
+	})
+	if calls != 1 {
+		t.Fatalf("unauthorized should not be retried, got %d calls", calls)
+	}
+	problem := engine.Problem(fmt.Errorf("wrapped: %w", err))
+	if problem.Class != engine.ClassUnauthorized || len(problem.SubProblems) != 1 || problem.Status != http.StatusForbidden {
+		t.Fatalf("unexpected problem: %+v", problem)
+	}
+}
+
+// go test ./engine -v -run TestRecordRetryAfter
+func TestRecordRetryAfter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/limited" {
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer ts.Close()
+	client, rec := engine.RecordRetryAfter(ts.Client())
+
+	rateLimited := acme.Problem{Type: "urn:ietf:params:acme:error:rateLimited", Status: http.StatusTooManyRequests}
+	rsp, err := client.Get(ts.URL + "/limited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	err = rec.Attach(rateLimited)
+	if after, ok := engine.RetryAfter(err); !ok || after != 3*time.Second {
+		t.Fatalf("expected Retry-After of 3s, got %v %v", after, ok)
+	}
+	if !engine.IsTransient(err) {
+		t.Fatal("rateLimited with Retry-After should be transient")
+	}
+
+	// a later response without Retry-After clears it
+	rsp, err = client.Get(ts.URL + "/ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if _, ok := engine.RetryAfter(rec.Attach(rateLimited)); ok {
+		t.Fatal("expected no Retry-After")
+	}
+}
@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/eggsampler/acme/v3"
+)
+
+// Identifiers builds the acme identifiers of names, ip addresses become "ip" identifiers (RFC 8738)
+func Identifiers(names []string) []acme.Identifier {
+	var ids []acme.Identifier
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			ids = append(ids, acme.Identifier{Type: "ip", Value: ip.String()})
+		} else {
+			ids = append(ids, acme.Identifier{Type: "dns", Value: name})
+		}
+	}
+	return ids
+}
+
+// DNSNames returns the values of the "dns" identifiers, for the csr DNSNames
+func DNSNames(ids []acme.Identifier) []string {
+	var names []string
+	for _, id := range ids {
+		if id.Type == "dns" {
+			names = append(names, id.Value)
+		}
+	}
+	return names
+}
+
+// IPAddresses returns the values of the "ip" identifiers, for the csr IPAddresses
+func IPAddresses(ids []acme.Identifier) []net.IP {
+	var ips []net.IP
+	for _, id := range ids {
+		if id.Type == "ip" {
+			ips = append(ips, net.ParseIP(id.Value))
+		}
+	}
+	return ips
+}
+
+// ReverseName returns the in-addr.arpa / ip6.arpa name of ip, which is the SNI of tls-alpn-01 for ip identifiers
+func ReverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	const hexDigits = "0123456789abcdef"
+	var b strings.Builder
+	ip16 := ip.To16()
+	for i := len(ip16) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[ip16[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[ip16[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa")
+	return b.String()
+}
@@ -0,0 +1,33 @@
+package engine_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+// go test ./engine -v -run TestIdentifiers
+func TestIdentifiers(t *testing.T) {
+	ids := engine.Identifiers([]string{"example.com", "192.0.2.1", "2001:db8::1"})
+	if ids[0].Type != "dns" || ids[1].Type != "ip" || ids[2].Type != "ip" {
+		t.Fatalf("unexpected identifiers: %v", ids)
+	}
+	if names := engine.DNSNames(ids); len(names) != 1 || names[0] != "example.com" {
+		t.Fatalf("unexpected dns names: %v", names)
+	}
+	if ips := engine.IPAddresses(ids); len(ips) != 2 || !ips[1].Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("unexpected ip addresses: %v", ips)
+	}
+}
+
+// go test ./engine -v -run TestReverseName
+func TestReverseName(t *testing.T) {
+	if name := engine.ReverseName(net.ParseIP("192.0.2.1")); name != "1.2.0.192.in-addr.arpa" {
+		t.Fatalf("unexpected reverse name: %s", name)
+	}
+	want := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"
+	if name := engine.ReverseName(net.ParseIP("2001:db8::1")); name != want {
+		t.Fatalf("unexpected reverse name: %s", name)
+	}
+}
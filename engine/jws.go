@@ -0,0 +1,218 @@
+package engine
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/eggsampler/acme/v3"
+	"github.com/nicennnnnnnlee/cert_bot/httpclient"
+)
+
+// Directory is the part of the acme directory that the library does not expose.
+type Directory struct {
+	NewNonce string `json:"newNonce"`
+	NewOrder string `json:"newOrder"`
+	Meta     struct {
+		Profiles      map[string]string `json:"profiles"`
+		CaaIdentities []string          `json:"caaIdentities"`
+	} `json:"meta"`
+}
+
+// directoryTTL is how long a fetched directory is used, e.g. before changed meta.profiles are seen
+const directoryTTL = time.Hour
+
+type cachedDirectory struct {
+	dir     *Directory
+	fetched time.Time
+}
+
+var (
+	directories   = make(map[string]cachedDirectory)
+	directoriesMu sync.Mutex
+)
+
+// FetchDirectory fetches the acme directory of directoryUrl, with httpClient or the default client if nil.
+// The directory is cached for directoryTTL.
+func FetchDirectory(httpClient *http.Client, directoryUrl string) (*Directory, error) {
+	directoriesMu.Lock()
+	defer directoriesMu.Unlock()
+	if cached, ok := directories[directoryUrl]; ok && time.Since(cached.fetched) < directoryTTL {
+		return cached.dir, nil
+	}
+	rsp, err := clientOrDefault(httpClient).Get(directoryUrl)
+	if err != nil {
+		return nil, Failover(fmt.Errorf("error fetching acme directory: %v", err))
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, Failover(fmt.Errorf("error fetching acme directory: %s", rsp.Status))
+	}
+	var dir Directory
+	if err := json.NewDecoder(rsp.Body).Decode(&dir); err != nil {
+		return nil, fmt.Errorf("error parsing acme directory: %v", err)
+	}
+	directories[directoryUrl] = cachedDirectory{dir: &dir, fetched: time.Now()}
+	return &dir, nil
+}
+
+func clientOrDefault(httpClient *http.Client) *http.Client {
+	if httpClient != nil {
+		return httpClient
+	}
+	return httpclient.Default()
+}
+
+func (dir *Directory) nonce(httpClient *http.Client) (string, error) {
+	rsp, err := clientOrDefault(httpClient).Head(dir.NewNonce)
+	if err != nil {
+		return "", fmt.Errorf("error fetching nonce: %v", err)
+	}
+	rsp.Body.Close()
+	nonce := rsp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", fmt.Errorf("no nonce in response of %s", dir.NewNonce)
+	}
+	return nonce, nil
+}
+
+// post sends a JWS signed request with the account key id, retrying once on badNonce
+func (dir *Directory) post(httpClient *http.Client, signer crypto.Signer, kid string, url string, payload interface{}, result interface{}) (*http.Response, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := dir.nonce(httpClient)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		body, err := signJWS(signer, kid, nonce, url, raw)
+		if err != nil {
+			return nil, err
+		}
+		rsp, err := clientOrDefault(httpClient).Post(url, "application/jose+json", bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("error posting %s: %v", url, err)
+		}
+		data, err := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading response of %s: %v", url, err)
+		}
+		if rsp.StatusCode >= 400 {
+			prob := problemOf(rsp, data)
+			if prob.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 0 && rsp.Header.Get("Replay-Nonce") != "" {
+				nonce = rsp.Header.Get("Replay-Nonce")
+				continue
+			}
+			return rsp, withRetryAfter(prob, rsp)
+		}
+		if result != nil {
+			if err := json.Unmarshal(data, result); err != nil {
+				return rsp, fmt.Errorf("error parsing response of %s: %v", url, err)
+			}
+		}
+		return rsp, nil
+	}
+}
+
+func signJWS(signer crypto.Signer, kid, nonce, url string, payload []byte) ([]byte, error) {
+	var alg string
+	var hash crypto.Hash
+	switch key := signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve.Params().BitSize {
+		case 256:
+			alg, hash = "ES256", crypto.SHA256
+		case 384:
+			alg, hash = "ES384", crypto.SHA384
+		case 521:
+			alg, hash = "ES512", crypto.SHA512
+		default:
+			return nil, fmt.Errorf("unsupported ecdsa curve: %s", key.Curve.Params().Name)
+		}
+	case *rsa.PublicKey:
+		alg, hash = "RS256", crypto.SHA256
+	default:
+		return nil, fmt.Errorf("unsupported account key type: %T", key)
+	}
+	protected, err := json.Marshal(map[string]string{
+		"alg":   alg,
+		"kid":   kid,
+		"nonce": nonce,
+		"url":   url,
+	})
+	if err != nil {
+		return nil, err
+	}
+	b64 := base64.RawURLEncoding
+	signingInput := b64.EncodeToString(protected) + "." + b64.EncodeToString(payload)
+	digest := hashOf(hash, []byte(signingInput))
+	sig, err := signer.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return nil, fmt.Errorf("error signing request: %v", err)
+	}
+	if key, ok := signer.Public().(*ecdsa.PublicKey); ok {
+		// JWS wants the raw r|s instead of the asn1 encoding
+		if sig, err = ecdsaRawSignature(sig, (key.Curve.Params().BitSize+7)/8); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(map[string]string{
+		"protected": b64.EncodeToString(protected),
+		"payload":   b64.EncodeToString(payload),
+		"signature": b64.EncodeToString(sig),
+	})
+}
+
+func hashOf(hash crypto.Hash, data []byte) []byte {
+	switch hash {
+	case crypto.SHA384:
+		sum := sha512.Sum384(data)
+		return sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(data)
+		return sum[:]
+	default:
+		sum := sha256.Sum256(data)
+		return sum[:]
+	}
+}
+
+func ecdsaRawSignature(der []byte, size int) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, fmt.Errorf("error decoding ecdsa signature: %v", err)
+	}
+	raw := make([]byte, 2*size)
+	sig.R.FillBytes(raw[:size])
+	sig.S.FillBytes(raw[size:])
+	return raw, nil
+}
+
+func problemOf(rsp *http.Response, data []byte) acme.Problem {
+	var prob acme.Problem
+	if err := json.Unmarshal(data, &prob); err != nil || prob.Type == "" {
+		prob = acme.Problem{Detail: string(data)}
+	}
+	if prob.Status == 0 {
+		prob.Status = rsp.StatusCode
+	}
+	return prob
+}
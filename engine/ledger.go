@@ -0,0 +1,270 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// kinds of ledger events
+const (
+	EventOrder            = "order"
+	EventFailedValidation = "failedValidation"
+	EventCertificate      = "certificate"
+)
+
+// LedgerEvent is an order, failed validation or issued certificate counted against the rate limits of a CA
+type LedgerEvent struct {
+	Time         time.Time `json:"time"`
+	Kind         string    `json:"kind"`
+	DirectoryUrl string    `json:"directoryUrl"`
+	Account      string    `json:"account"`
+	// Names are the sorted names of the order or certificate, the hostname of a failed validation
+	Names []string `json:"names"`
+}
+
+// Limits are the known rate limits of a CA
+type Limits struct {
+	// certificates per registered domain
+	CertsPerDomain       int           `json:"certsPerDomain"`
+	CertsPerDomainWindow time.Duration `json:"-"`
+	// certificates for the exact same set of names
+	DuplicateCerts       int           `json:"duplicateCerts"`
+	DuplicateCertsWindow time.Duration `json:"-"`
+	// failed validations per account and hostname
+	FailedValidations       int           `json:"failedValidations"`
+	FailedValidationsWindow time.Duration `json:"-"`
+	// new orders per account
+	Orders       int           `json:"orders"`
+	OrdersWindow time.Duration `json:"-"`
+}
+
+// LetsEncryptLimits are the published limits of Let's Encrypt production
+var LetsEncryptLimits = Limits{
+	CertsPerDomain: 50, CertsPerDomainWindow: 7 * 24 * time.Hour,
+	DuplicateCerts: 5, DuplicateCertsWindow: 7 * 24 * time.Hour,
+	FailedValidations: 5, FailedValidationsWindow: time.Hour,
+	Orders: 300, OrdersWindow: 3 * time.Hour,
+}
+
+// LimitsFor returns the known limits of the CA
+func LimitsFor(directoryUrl string) (Limits, bool) {
+	if directoryUrl == DirectoryPresets["letsencrypt"] {
+		return LetsEncryptLimits, true
+	}
+	return Limits{}, false
+}
+
+// Budget is what is left of the limits for an order
+type Budget struct {
+	Orders                int            `json:"orders"`
+	DuplicateCertificates int            `json:"duplicateCertificates"`
+	CertificatesPerDomain map[string]int `json:"certificatesPerDomain"`
+	FailedValidations     map[string]int `json:"failedValidations"`
+}
+
+// Exhausted lists the limits the next order would exceed
+func (b *Budget) Exhausted() []string {
+	return b.below(1)
+}
+
+// Low lists the limits the next order would use up
+func (b *Budget) Low() []string {
+	return b.below(2)
+}
+
+func (b *Budget) below(n int) []string {
+	var limits []string
+	if b.Orders < n {
+		limits = append(limits, fmt.Sprintf("new orders per account: %d left", b.Orders))
+	}
+	if b.DuplicateCertificates < n {
+		limits = append(limits, fmt.Sprintf("duplicate certificates: %d left", b.DuplicateCertificates))
+	}
+	for _, domain := range sortedKeys(b.CertificatesPerDomain) {
+		if left := b.CertificatesPerDomain[domain]; left < n {
+			limits = append(limits, fmt.Sprintf("certificates per domain %s: %d left", domain, left))
+		}
+	}
+	for _, name := range sortedKeys(b.FailedValidations) {
+		if left := b.FailedValidations[name]; left < n {
+			limits = append(limits, fmt.Sprintf("failed validations of %s: %d left", name, left))
+		}
+	}
+	return limits
+}
+
+// Min returns the budget left by both b and other, for certificates ordered together
+func (b *Budget) Min(other *Budget) *Budget {
+	if b == nil {
+		return other
+	}
+	least := &Budget{
+		Orders:                min(b.Orders, other.Orders),
+		DuplicateCertificates: min(b.DuplicateCertificates, other.DuplicateCertificates),
+		CertificatesPerDomain: make(map[string]int),
+		FailedValidations:     make(map[string]int),
+	}
+	for _, m := range []*Budget{b, other} {
+		for k, v := range m.CertificatesPerDomain {
+			if old, ok := least.CertificatesPerDomain[k]; !ok || v < old {
+				least.CertificatesPerDomain[k] = v
+			}
+		}
+		for k, v := range m.FailedValidations {
+			if old, ok := least.FailedValidations[k]; !ok || v < old {
+				least.FailedValidations[k] = v
+			}
+		}
+	}
+	return least
+}
+
+// Ledger keeps the events counted against the rate limits, saved to a file if it has a path
+type Ledger struct {
+	mu     sync.Mutex
+	path   string
+	Events []LedgerEvent `json:"events"`
+}
+
+// OpenLedger loads the ledger file, an empty path keeps the ledger in memory
+func OpenLedger(path string) (*Ledger, error) {
+	l := &Ledger{path: path}
+	if path == "" {
+		return l, nil
+	}
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading ledger %q: %v", path, err)
+	}
+	if err := json.Unmarshal(raw, l); err != nil {
+		return nil, fmt.Errorf("error parsing ledger %q: %v", path, err)
+	}
+	return l, nil
+}
+
+// Record adds an event, events older than the longest window are dropped
+func (l *Ledger) Record(kind string, directoryUrl string, account string, names []string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	events := l.Events[:0]
+	for _, e := range l.Events {
+		if now.Sub(e.Time) < 7*24*time.Hour {
+			events = append(events, e)
+		}
+	}
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	l.Events = append(events, LedgerEvent{Time: now, Kind: kind, DirectoryUrl: directoryUrl, Account: account, Names: sorted})
+	if l.path == "" {
+		return nil
+	}
+	raw, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("error encoding ledger: %v", err)
+	}
+	// a crash while writing must not truncate the ledger, write a temporary file and rename it
+	tmp, err := writeTemp(l.path, raw)
+	if err != nil {
+		return fmt.Errorf("error saving ledger %q: %v", l.path, err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error saving ledger %q: %v", l.path, err)
+	}
+	return nil
+}
+
+// Budget returns what is left of limits for an order of names by the account
+func (l *Ledger) Budget(limits Limits, directoryUrl string, account string, names []string, now time.Time) *Budget {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	set := strings.Join(sorted, ",")
+	domains := make(map[string]bool)
+	b := &Budget{
+		Orders:                limits.Orders,
+		DuplicateCertificates: limits.DuplicateCerts,
+		CertificatesPerDomain: make(map[string]int),
+		FailedValidations:     make(map[string]int),
+	}
+	for _, name := range sorted {
+		domain := RegisteredDomain(name)
+		domains[domain] = true
+		b.CertificatesPerDomain[domain] = limits.CertsPerDomain
+		b.FailedValidations[name] = limits.FailedValidations
+	}
+	within := func(e LedgerEvent, window time.Duration) bool {
+		return now.Sub(e.Time) < window
+	}
+	for _, e := range l.Events {
+		if e.DirectoryUrl != directoryUrl {
+			continue
+		}
+		switch e.Kind {
+		case EventOrder:
+			if e.Account == account && within(e, limits.OrdersWindow) {
+				b.Orders--
+			}
+		case EventFailedValidation:
+			if e.Account == account && within(e, limits.FailedValidationsWindow) {
+				for _, name := range e.Names {
+					if _, ok := b.FailedValidations[name]; ok {
+						b.FailedValidations[name]--
+					}
+				}
+			}
+		case EventCertificate:
+			if within(e, limits.DuplicateCertsWindow) && strings.Join(e.Names, ",") == set {
+				b.DuplicateCertificates--
+			}
+			if within(e, limits.CertsPerDomainWindow) {
+				// a certificate counts once per registered domain
+				counted := make(map[string]bool)
+				for _, name := range e.Names {
+					domain := RegisteredDomain(name)
+					if domains[domain] && !counted[domain] {
+						b.CertificatesPerDomain[domain]--
+						counted[domain] = true
+					}
+				}
+			}
+		}
+	}
+	return b
+}
+
+// RegisteredDomain returns the registered domain of name by the public suffix list, e.g. example.co.uk for a.example.co.uk
+// and alice.github.io for www.alice.github.io. Ip addresses and public suffixes are returned as is.
+func RegisteredDomain(name string) string {
+	if net.ParseIP(name) != nil {
+		return name
+	}
+	name = strings.TrimPrefix(strings.ToLower(name), "*.")
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return name
+	}
+	return domain
+}
+
+func sortedKeys(m map[string]int) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,68 @@
+package engine_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+// go test ./engine -v -run TestLedgerBudget
+func TestLedgerBudget(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+	ledger, err := engine.OpenLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := engine.DirectoryPresets["letsencrypt"]
+	names := []string{"www.example.co.uk", "example.co.uk"}
+	for i := 0; i < 5; i++ {
+		ledger.Record(engine.EventCertificate, dir, "acct1", names)
+	}
+	ledger.Record(engine.EventFailedValidation, dir, "acct1", []string{"example.co.uk"})
+	ledger.Record(engine.EventOrder, dir, "acct2", names)
+
+	// reopen to check that the events are saved
+	ledger, err = engine.OpenLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := ledger.Budget(engine.LetsEncryptLimits, dir, "acct1", []string{"example.co.uk", "www.example.co.uk"}, time.Now())
+	if b.DuplicateCertificates != 0 || b.CertificatesPerDomain["example.co.uk"] != 45 ||
+		b.FailedValidations["example.co.uk"] != 4 || b.Orders != 300 {
+		t.Fatalf("unexpected budget: %+v", b)
+	}
+	if len(b.Exhausted()) != 1 {
+		t.Fatalf("expected the duplicate limit to be exhausted, got %v", b.Exhausted())
+	}
+
+	later := ledger.Budget(engine.LetsEncryptLimits, dir, "acct1", names, time.Now().Add(8*24*time.Hour))
+	if later.DuplicateCertificates != 5 || len(later.Exhausted()) != 0 {
+		t.Fatalf("events outside the window should not count: %+v", later)
+	}
+}
+
+// go test ./engine -v -run TestRegisteredDomain
+func TestRegisteredDomain(t *testing.T) {
+	for name, want := range map[string]string{
+		"www.example.com":     "example.com",
+		"*.www.example.com":   "example.com",
+		"example.com":         "example.com",
+		"a.example.co.uk":     "example.co.uk",
+		"a.foo.com.br":        "foo.com.br",
+		"b.bar.com.br":        "bar.com.br",
+		"x.y.example.co.id":   "example.co.id",
+		"www.alice.github.io": "alice.github.io",
+		"bob.github.io":       "bob.github.io",
+		"app.herokuapp.com":   "app.herokuapp.com",
+		"xn--fiq228c.com":     "xn--fiq228c.com",
+		"co.uk":               "co.uk",
+		"192.0.2.1":           "192.0.2.1",
+		"2001:db8::1":         "2001:db8::1",
+	} {
+		if got := engine.RegisteredDomain(name); got != want {
+			t.Errorf("RegisteredDomain(%q) = %q, expected %q", name, got, want)
+		}
+	}
+}
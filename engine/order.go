@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eggsampler/acme/v3"
+)
+
+// OrderOptions are the newOrder fields that acme.Client.NewOrder does not send.
+type OrderOptions struct {
+	// Profile is one of the profiles advertised in the directory meta, e.g. "shortlived", "tlsserver"
+	Profile string
+	// NotBefore and NotAfter request the validity of the certificate, not every CA supports them
+	NotBefore time.Time
+	NotAfter  time.Time
+	// HTTPClient the order is posted with, the default client if nil
+	HTTPClient *http.Client
+}
+
+func (opts OrderOptions) isZero() bool {
+	return opts.Profile == "" && opts.NotBefore.IsZero() && opts.NotAfter.IsZero()
+}
+
+func formatOrderTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// NewOrder creates a new order for ids. Orders without extra options go through the acme client as usual.
+func NewOrder(client acme.Client, account acme.Account, directoryUrl string, ids []acme.Identifier, opts OrderOptions) (acme.Order, error) {
+	if opts.isZero() {
+		return client.NewOrder(account, ids)
+	}
+	dir, err := FetchDirectory(opts.HTTPClient, directoryUrl)
+	if err != nil {
+		return acme.Order{}, err
+	}
+	if err := dir.ValidateProfile(opts.Profile); err != nil {
+		return acme.Order{}, err
+	}
+	payload := struct {
+		Identifiers []acme.Identifier `json:"identifiers"`
+		Profile     string            `json:"profile,omitempty"`
+		NotBefore   string            `json:"notBefore,omitempty"`
+		NotAfter    string            `json:"notAfter,omitempty"`
+	}{
+		Identifiers: ids,
+		Profile:     opts.Profile,
+		NotBefore:   formatOrderTime(opts.NotBefore),
+		NotAfter:    formatOrderTime(opts.NotAfter),
+	}
+	var order acme.Order
+	rsp, err := dir.post(opts.HTTPClient, account.PrivateKey, account.URL, dir.NewOrder, payload, &order)
+	if err != nil {
+		if prob, ok := AsProblem(err); ok && prob.Type == "urn:ietf:params:acme:error:malformed" && (payload.NotBefore != "" || payload.NotAfter != "") {
+			return acme.Order{}, fmt.Errorf("the CA may not support notBefore/notAfter: %w", err)
+		}
+		return acme.Order{}, err
+	}
+	order.URL = rsp.Header.Get("Location")
+	return order, nil
+}
+
+// Profiles returns the names of the profiles advertised by the CA
+func (dir *Directory) Profiles() []string {
+	var names []string
+	for name := range dir.Meta.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateProfile checks that the CA advertises the profile
+func (dir *Directory) ValidateProfile(profile string) error {
+	if profile == "" {
+		return nil
+	}
+	if _, ok := dir.Meta.Profiles[profile]; ok {
+		return nil
+	}
+	if len(dir.Meta.Profiles) == 0 {
+		return fmt.Errorf("profile %q is not supported: the CA advertises no profiles", profile)
+	}
+	return fmt.Errorf("profile %q is not supported, available profiles: %s", profile, strings.Join(dir.Profiles(), ", "))
+}
+
+// shortLivedLifetime is the lifetime below which a certificate counts as short-lived, e.g. the 6-day certificates
+const shortLivedLifetime = 10 * 24 * time.Hour
+
+// RenewalTime returns when the certificate is due for renewal.
+// Certificates are renewed when a third of their lifetime is left, short-lived ones at half of their lifetime.
+func RenewalTime(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	if lifetime < shortLivedLifetime {
+		return cert.NotBefore.Add(lifetime / 2)
+	}
+	return cert.NotAfter.Add(-lifetime / 3)
+}
@@ -0,0 +1,34 @@
+package engine_test
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+// go test ./engine -v -run TestRenewalTime
+func TestRenewalTime(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	ninetyDays := &x509.Certificate{NotBefore: now, NotAfter: now.Add(90 * 24 * time.Hour)}
+	if got := engine.RenewalTime(ninetyDays); !got.Equal(now.Add(60 * 24 * time.Hour)) {
+		t.Fatalf("90-day certificate: unexpected renewal time %s", got)
+	}
+	sixDays := &x509.Certificate{NotBefore: now, NotAfter: now.Add(6 * 24 * time.Hour)}
+	if got := engine.RenewalTime(sixDays); !got.Equal(now.Add(3 * 24 * time.Hour)) {
+		t.Fatalf("6-day certificate: unexpected renewal time %s", got)
+	}
+}
+
+// go test ./engine -v -run TestValidateProfile
+func TestValidateProfile(t *testing.T) {
+	dir := &engine.Directory{}
+	dir.Meta.Profiles = map[string]string{"classic": "", "shortlived": ""}
+	if err := dir.ValidateProfile("shortlived"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.ValidateProfile("tlsclient"); err == nil {
+		t.Fatal("tlsclient should not be valid")
+	}
+}
@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/eggsampler/acme/v3"
+)
+
+// PreflightOptions configures the checks run before an order is created
+type PreflightOptions struct {
+	// DNSServer (host:port) the records are looked up on
+	DNSServer string
+	// CAIdentities are the caaIdentities of the directory of the CA
+	CAIdentities []string
+	// AccountURI is matched against the accounturi CAA parameter
+	AccountURI string
+	// ChallengeType returns the challenge an identifier will be validated with
+	ChallengeType func(id acme.Identifier) string
+}
+
+// PreflightResult is the result of one check of one identifier
+type PreflightResult struct {
+	Identifier string `json:"identifier"`
+	Check      string `json:"check"`
+	OK         bool   `json:"ok"`
+	Detail     string `json:"detail"`
+}
+
+// PreflightReport lists the results of Preflight
+type PreflightReport struct {
+	Results []PreflightResult `json:"results"`
+}
+
+func (r *PreflightReport) add(id acme.Identifier, check string, ok bool, detail string) {
+	r.Results = append(r.Results, PreflightResult{Identifier: id.Value, Check: check, OK: ok, Detail: detail})
+}
+
+// OK reports whether all the checks passed
+func (r *PreflightReport) OK() bool {
+	for _, result := range r.Results {
+		if !result.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// Err returns the failed checks as an error, nil when all passed.
+// When only CAA checks failed the error is marked for failover, another CA may be allowed.
+func (r *PreflightReport) Err() error {
+	var failed []string
+	onlyCAA := true
+	for _, result := range r.Results {
+		if !result.OK {
+			failed = append(failed, fmt.Sprintf("%s %s: %s", result.Check, result.Identifier, result.Detail))
+			onlyCAA = onlyCAA && result.Check == "caa"
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	err := fmt.Errorf("preflight checks failed: %s", strings.Join(failed, "; "))
+	if onlyCAA {
+		return Failover(err)
+	}
+	return err
+}
+
+// Lines returns one readable line per result, for logs
+func (r *PreflightReport) Lines() []string {
+	var lines []string
+	for _, result := range r.Results {
+		status := "ok"
+		if !result.OK {
+			status = "FAILED"
+		}
+		lines = append(lines, fmt.Sprintf("[%s] %s %s: %s", status, result.Check, result.Identifier, result.Detail))
+	}
+	return lines
+}
+
+// Preflight checks the CAA records of every dns identifier and,
+// for identifiers validated by http-01 or tls-alpn-01, that the name resolves to an address.
+func Preflight(ids []acme.Identifier, opts PreflightOptions) *PreflightReport {
+	report := &PreflightReport{}
+	for _, id := range ids {
+		if id.Type != "dns" {
+			// CAA does not apply to ip identifiers
+			continue
+		}
+		method := acme.ChallengeTypeDNS01
+		if opts.ChallengeType != nil {
+			method = opts.ChallengeType(id)
+		}
+		wildcard := strings.HasPrefix(id.Value, "*.")
+		records, at, err := LookupCAASet(opts.DNSServer, id.Value)
+		if err != nil {
+			report.add(id, "caa", false, err.Error())
+		} else if len(records) == 0 {
+			report.add(id, "caa", true, "no CAA records")
+		} else {
+			ok, reason := CAAAllows(records, wildcard, opts.CAIdentities, opts.AccountURI, method)
+			report.add(id, "caa", ok, fmt.Sprintf("%s (records at %s)", reason, at))
+		}
+
+		if method == acme.ChallengeTypeHTTP01 || method == acme.ChallengeTypeTLSALPN01 {
+			addrs, err := lookupAddrs(opts.DNSServer, id.Value)
+			if err != nil {
+				report.add(id, "dns", false, fmt.Sprintf("no A/AAAA records for %s: %v", method, err))
+			} else {
+				report.add(id, "dns", true, strings.Join(addrs, ","))
+			}
+		}
+	}
+	return report
+}
+
+func lookupAddrs(dnsServer string, name string) ([]string, error) {
+	resolver := net.DefaultResolver
+	if dnsServer != "" {
+		var dialer net.Dialer
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "udp", dnsServer)
+			},
+		}
+	}
+	addrs, err := resolver.LookupIPAddr(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, addr := range addrs {
+		values = append(values, addr.IP.String())
+	}
+	return values, nil
+}
@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eggsampler/acme/v3"
+)
+
+// ACMETLS1Protocol is the ALPN protocol of the tls-alpn-01 challenge (RFC 8737)
+const ACMETLS1Protocol = "acme-tls/1"
+
+const http01PathPrefix = "/.well-known/acme-challenge/"
+
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// HTTP01Responder serves the key authorizations of pending http-01 challenges from memory
+type HTTP01Responder struct {
+	tokens sync.Map
+}
+
+func (r *HTTP01Responder) Add(token, keyAuthorization string) {
+	r.tokens.Store(token, keyAuthorization)
+}
+
+func (r *HTTP01Responder) Remove(token string) {
+	r.tokens.Delete(token)
+}
+
+// Handler serves the known challenge tokens and passes every other request to next
+func (r *HTTP01Responder) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, http01PathPrefix) {
+			if keyAuth, ok := r.tokens.Load(strings.TrimPrefix(req.URL.Path, http01PathPrefix)); ok {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte(keyAuth.(string)))
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (r *HTTP01Responder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Handler(http.NotFoundHandler()).ServeHTTP(w, req)
+}
+
+// TLSALPN01Responder answers tls-alpn-01 handshakes with the challenge certificates of pending authorizations
+type TLSALPN01Responder struct {
+	mu    sync.RWMutex
+	certs map[string]*tls.Certificate
+}
+
+func sniOf(id acme.Identifier) string {
+	if id.Type == "ip" {
+		return ReverseName(net.ParseIP(id.Value))
+	}
+	return strings.ToLower(id.Value)
+}
+
+func (r *TLSALPN01Responder) Add(id acme.Identifier, keyAuthorization string) error {
+	cert, err := TLSALPN01Certificate(id, keyAuthorization)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.certs == nil {
+		r.certs = make(map[string]*tls.Certificate)
+	}
+	r.certs[sniOf(id)] = cert
+	return nil
+}
+
+func (r *TLSALPN01Responder) Remove(id acme.Identifier) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.certs, sniOf(id))
+}
+
+// IsChallenge reports whether the handshake is a tls-alpn-01 validation
+func IsChallenge(hello *tls.ClientHelloInfo) bool {
+	for _, proto := range hello.SupportedProtos {
+		if proto == ACMETLS1Protocol {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *TLSALPN01Responder) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if cert, ok := r.certs[strings.ToLower(hello.ServerName)]; ok {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no tls-alpn-01 challenge for %q", hello.ServerName)
+}
+
+func (r *TLSALPN01Responder) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		NextProtos:     []string{ACMETLS1Protocol},
+	}
+}
+
+// Serve completes the handshake of every connection and closes it, the validation needs nothing else
+func (r *TLSALPN01Responder) Serve(l net.Listener) error {
+	conf := r.TLSConfig()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			tlsConn := tls.Server(conn, conf)
+			tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+			if err := tlsConn.Handshake(); err != nil {
+				log.Println("tls-alpn-01 handshake:", err)
+			}
+		}()
+	}
+}
+
+// TLSALPN01Certificate creates the self-signed challenge certificate carrying the acmeIdentifier extension
+func TLSALPN01Certificate(id acme.Identifier, keyAuthorization string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error generating challenge key: %v", err)
+	}
+	sum := sha256.Sum256([]byte(keyAuthorization))
+	extValue, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tpl := &x509.Certificate{
+		SerialNumber:    serial,
+		Subject:         pkix.Name{CommonName: "ACME challenge"},
+		NotBefore:       now.Add(-time.Hour),
+		NotAfter:        now.Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: idPeAcmeIdentifier, Critical: true, Value: extValue}},
+	}
+	if id.Type == "ip" {
+		tpl.IPAddresses = []net.IP{net.ParseIP(id.Value)}
+	} else {
+		tpl.DNSNames = []string{id.Value}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating challenge certificate: %v", err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,165 @@
+package engine
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eggsampler/acme/v3"
+)
+
+// OrderState is the progress of an order, saved so that it can be resumed after a crash or restart
+// instead of creating a new order that counts against the rate limits.
+type OrderState struct {
+	DirectoryUrl string   `json:"directoryUrl"`
+	AccountUrl   string   `json:"accountUrl"`
+	OrderUrl     string   `json:"orderUrl"`
+	Identifiers  []string `json:"identifiers"`
+	// Authorizations maps the authorization urls to their last known status
+	Authorizations map[string]string `json:"authorizations"`
+	// Key is the pem encoded private key the certificate is planned with
+	Key     string    `json:"key,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// OrderStatePath returns the file the order state of the certificate at certPath is saved to
+func OrderStatePath(certPath string) string {
+	return certPath + ".order.json"
+}
+
+// NewOrderState returns the state of a newly created order of ids
+func NewOrderState(directoryUrl string, accountUrl string, order acme.Order, ids []acme.Identifier) *OrderState {
+	state := &OrderState{
+		DirectoryUrl:   directoryUrl,
+		AccountUrl:     accountUrl,
+		OrderUrl:       order.URL,
+		Identifiers:    sortedValues(ids),
+		Authorizations: make(map[string]string),
+	}
+	for _, authUrl := range order.Authorizations {
+		state.Authorizations[authUrl] = "pending"
+	}
+	return state
+}
+
+// LoadOrderState reads the order state file, it returns nil without error if there is none
+func LoadOrderState(path string) (*OrderState, error) {
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading order state %q: %v", path, err)
+	}
+	var state OrderState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, fmt.Errorf("error parsing order state %q: %v", path, err)
+	}
+	return &state, nil
+}
+
+// Save writes the state atomically, readable by the owner only since it holds the planned key
+func (state *OrderState) Save(path string) error {
+	state.Updated = time.Now()
+	raw, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding order state: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error saving order state %q: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error saving order state %q: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error saving order state %q: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error saving order state %q: %v", path, err)
+	}
+	return nil
+}
+
+// RemoveOrderState removes the order state file, once the certificate is issued
+func RemoveOrderState(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing order state %q: %v", path, err)
+	}
+	return nil
+}
+
+// SetAuthorization records the status of an authorization
+func (state *OrderState) SetAuthorization(authUrl string, status string) {
+	if state.Authorizations == nil {
+		state.Authorizations = make(map[string]string)
+	}
+	state.Authorizations[authUrl] = status
+}
+
+// PlannedKey returns the certificate key of the order, generating it on first use
+func (state *OrderState) PlannedKey() (*ecdsa.PrivateKey, error) {
+	if state.Key != "" {
+		b, _ := pem.Decode([]byte(state.Key))
+		if b == nil {
+			return nil, fmt.Errorf("error decoding planned key: no pem block")
+		}
+		key, err := x509.ParseECPrivateKey(b.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding planned key: %v", err)
+		}
+		return key, nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error generating certificate key: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding certificate key: %v", err)
+	}
+	state.Key = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	return key, nil
+}
+
+// Matches reports whether the state belongs to an order of ids placed by the account on the CA
+func (state *OrderState) Matches(directoryUrl string, accountUrl string, ids []acme.Identifier) bool {
+	return state != nil && state.OrderUrl != "" &&
+		state.DirectoryUrl == directoryUrl && state.AccountUrl == accountUrl &&
+		strings.Join(state.Identifiers, ",") == strings.Join(sortedValues(ids), ",")
+}
+
+// ResumeOrder fetches the order of state, it is resumable while it is still pending or ready
+func ResumeOrder(client acme.Client, account acme.Account, state *OrderState) (acme.Order, error) {
+	order, err := client.FetchOrder(account, state.OrderUrl)
+	if err != nil {
+		return order, fmt.Errorf("error fetching order %q: %w", state.OrderUrl, err)
+	}
+	if order.URL == "" {
+		order.URL = state.OrderUrl
+	}
+	if order.Status != "pending" && order.Status != "ready" {
+		return order, fmt.Errorf("order %q is %s", state.OrderUrl, order.Status)
+	}
+	return order, nil
+}
+
+func sortedValues(ids []acme.Identifier) []string {
+	var values []string
+	for _, id := range ids {
+		values = append(values, strings.ToLower(id.Type+":"+id.Value))
+	}
+	sort.Strings(values)
+	return values
+}
@@ -0,0 +1,51 @@
+package engine_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/eggsampler/acme/v3"
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+// go test ./engine -v -run TestOrderState
+func TestOrderState(t *testing.T) {
+	ids := []acme.Identifier{{Type: "dns", Value: "b.example.com"}, {Type: "dns", Value: "a.example.com"}}
+	order := acme.Order{URL: "https://ca/order/1", Authorizations: []string{"https://ca/authz/1", "https://ca/authz/2"}}
+	state := engine.NewOrderState("https://ca/dir", "https://ca/acct/1", order, ids)
+	key, err := state.PlannedKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.SetAuthorization("https://ca/authz/1", "valid")
+
+	path := engine.OrderStatePath(filepath.Join(t.TempDir(), "cert.pem"))
+	if err := state.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := engine.LoadOrderState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reversed := []acme.Identifier{ids[1], ids[0]}
+	if !loaded.Matches("https://ca/dir", "https://ca/acct/1", reversed) {
+		t.Fatalf("loaded state should match its order: %+v", loaded)
+	}
+	if loaded.Matches("https://ca/dir", "https://ca/acct/2", ids) || loaded.Matches("https://ca/dir", "https://ca/acct/1", ids[:1]) {
+		t.Fatal("state should not match another account or other identifiers")
+	}
+	if loaded.Authorizations["https://ca/authz/1"] != "valid" {
+		t.Fatalf("authorization status not saved: %v", loaded.Authorizations)
+	}
+	loadedKey, err := loaded.PlannedKey()
+	if err != nil || !loadedKey.Equal(key) {
+		t.Fatalf("planned key not kept: %v", err)
+	}
+
+	if err := engine.RemoveOrderState(path); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := engine.LoadOrderState(path); loaded != nil || err != nil {
+		t.Fatalf("expected no state after removal, got %v %v", loaded, err)
+	}
+}
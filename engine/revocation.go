@@ -0,0 +1,378 @@
+package engine
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// Revocation statuses of a certificate
+const (
+	RevocationGood    = "good"
+	RevocationRevoked = "revoked"
+	RevocationUnknown = "unknown"
+)
+
+// RevocationStatus is the revocation status of a certificate, from OCSP or a CRL
+type RevocationStatus struct {
+	Status string `json:"status"`
+	// Source is "ocsp" or "crl"
+	Source    string    `json:"source"`
+	RevokedAt time.Time `json:"revokedAt,omitempty"`
+	// Reason is the CRLReason code of a revoked certificate
+	Reason     int       `json:"reason,omitempty"`
+	ThisUpdate time.Time `json:"thisUpdate"`
+	NextUpdate time.Time `json:"nextUpdate,omitempty"`
+	Checked    time.Time `json:"checked"`
+	// Staple is the raw OCSP response, to staple in the TLS handshake
+	Staple []byte `json:"-"`
+}
+
+// RefreshAt is when the status should be checked again: halfway to NextUpdate, or after an hour without one
+func (s *RevocationStatus) RefreshAt() time.Time {
+	if s.NextUpdate.IsZero() || !s.NextUpdate.After(s.ThisUpdate) {
+		return s.Checked.Add(time.Hour)
+	}
+	return s.ThisUpdate.Add(s.NextUpdate.Sub(s.ThisUpdate) / 2)
+}
+
+// Fresh reports whether the status is current at now: an OCSP response past its NextUpdate must not be stapled,
+// clients reject it, hard for must-staple certificates
+func (s *RevocationStatus) Fresh(now time.Time) bool {
+	return !now.Before(s.ThisUpdate.Add(-ocspClockSkew)) && (s.NextUpdate.IsZero() || now.Before(s.NextUpdate))
+}
+
+// ocspClockSkew is the tolerance for a ThisUpdate in the future
+const ocspClockSkew = 5 * time.Minute
+
+var (
+	oidSHA1              = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidOCSPBasicResponse = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+	signatureAlgorithms = []struct {
+		oid  asn1.ObjectIdentifier
+		algo x509.SignatureAlgorithm
+	}{
+		{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}, x509.SHA1WithRSA},
+		{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}, x509.SHA256WithRSA},
+		{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}, x509.SHA384WithRSA},
+		{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}, x509.SHA512WithRSA},
+		{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}, x509.ECDSAWithSHA1},
+		{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}, x509.ECDSAWithSHA256},
+		{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}, x509.ECDSAWithSHA384},
+		{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}, x509.ECDSAWithSHA512},
+		{asn1.ObjectIdentifier{1, 3, 101, 112}, x509.PureEd25519},
+	}
+)
+
+// the OCSP structures of RFC 6960, only what a client needs
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest struct {
+		RequestList []struct {
+			Cert ocspCertID
+		}
+	}
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response struct {
+		ResponseType asn1.ObjectIdentifier
+		Response     []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+type basicOCSPResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version        int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID asn1.RawValue
+	ProducedAt     time.Time `asn1:"generalized"`
+	Responses      []ocspSingleResponse
+	Extensions     []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID  ocspCertID
+	Good    asn1.Flag `asn1:"tag:0,optional"`
+	Revoked struct {
+		RevocationTime time.Time       `asn1:"generalized"`
+		Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+	} `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate time.Time        `asn1:"generalized"`
+	NextUpdate time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	Extensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+// issuerKeyHash is the sha1 of the subjectPublicKey bit string of the issuer
+func issuerKeyHash(issuer *x509.Certificate) ([]byte, error) {
+	return issuerKeyHashWith(crypto.SHA1, issuer)
+}
+
+func issuerKeyHashWith(hash crypto.Hash, issuer *x509.Certificate) ([]byte, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, fmt.Errorf("error parsing issuer public key: %v", err)
+	}
+	h := hash.New()
+	h.Write(spki.PublicKey.RightAlign())
+	return h.Sum(nil), nil
+}
+
+// matches reports whether the CertID identifies leaf issued by issuer: the serial,
+// and the hashes of the issuer name and key with the hash algorithm of the CertID
+func (id ocspCertID) matches(leaf, issuer *x509.Certificate) bool {
+	if id.SerialNumber == nil || id.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		return false
+	}
+	var hash crypto.Hash
+	switch {
+	case id.HashAlgorithm.Algorithm.Equal(oidSHA1):
+		hash = crypto.SHA1
+	case id.HashAlgorithm.Algorithm.Equal(oidSHA256):
+		hash = crypto.SHA256
+	case id.HashAlgorithm.Algorithm.Equal(oidSHA384):
+		hash = crypto.SHA384
+	case id.HashAlgorithm.Algorithm.Equal(oidSHA512):
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+	h := hash.New()
+	h.Write(issuer.RawSubject)
+	if !bytes.Equal(id.NameHash, h.Sum(nil)) {
+		return false
+	}
+	keyHash, err := issuerKeyHashWith(hash, issuer)
+	return err == nil && bytes.Equal(id.IssuerKeyHash, keyHash)
+}
+
+// CreateOCSPRequest creates the DER encoded OCSP request of leaf
+func CreateOCSPRequest(leaf, issuer *x509.Certificate) ([]byte, error) {
+	keyHash, err := issuerKeyHash(issuer)
+	if err != nil {
+		return nil, err
+	}
+	nameHash := sha1.Sum(issuer.RawSubject)
+	var req ocspRequest
+	req.TBSRequest.RequestList = make([]struct{ Cert ocspCertID }, 1)
+	req.TBSRequest.RequestList[0].Cert = ocspCertID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash[:],
+		IssuerKeyHash: keyHash,
+		SerialNumber:  leaf.SerialNumber,
+	}
+	return asn1.Marshal(req)
+}
+
+// ParseOCSPResponse parses a DER encoded OCSP response of leaf and checks that it is signed by issuer,
+// directly or by a valid responder certificate the issuer delegated OCSP signing to.
+// The response must identify leaf by issuer and serial, and be current: ThisUpdate <= now < NextUpdate.
+func ParseOCSPResponse(raw []byte, leaf, issuer *x509.Certificate) (*RevocationStatus, error) {
+	now := time.Now()
+	var resp ocspResponse
+	if rest, err := asn1.Unmarshal(raw, &resp); err != nil {
+		return nil, fmt.Errorf("error parsing ocsp response: %v", err)
+	} else if len(rest) > 0 {
+		return nil, fmt.Errorf("trailing data in ocsp response")
+	}
+	if resp.Status != 0 {
+		return nil, fmt.Errorf("ocsp responder returned status %d", resp.Status)
+	}
+	if !resp.Response.ResponseType.Equal(oidOCSPBasicResponse) {
+		return nil, fmt.Errorf("ocsp response type %v is not supported", resp.Response.ResponseType)
+	}
+	var basic basicOCSPResponse
+	if _, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil {
+		return nil, fmt.Errorf("error parsing basic ocsp response: %v", err)
+	}
+	var data ocspResponseData
+	if _, err := asn1.Unmarshal(basic.TBSResponseData.FullBytes, &data); err != nil {
+		return nil, fmt.Errorf("error parsing ocsp response data: %v", err)
+	}
+
+	algo := x509.UnknownSignatureAlgorithm
+	for _, a := range signatureAlgorithms {
+		if a.oid.Equal(basic.SignatureAlgorithm.Algorithm) {
+			algo = a.algo
+		}
+	}
+	signer := issuer
+	if len(basic.Certificates) > 0 {
+		responder, err := x509.ParseCertificate(basic.Certificates[0].FullBytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing ocsp responder certificate: %v", err)
+		}
+		if !bytes.Equal(responder.Raw, issuer.Raw) {
+			if err := responder.CheckSignatureFrom(issuer); err != nil {
+				return nil, fmt.Errorf("ocsp responder certificate is not issued by the issuer: %v", err)
+			}
+			delegated := false
+			for _, usage := range responder.ExtKeyUsage {
+				delegated = delegated || usage == x509.ExtKeyUsageOCSPSigning
+			}
+			if !delegated {
+				return nil, fmt.Errorf("ocsp responder certificate is not delegated to sign ocsp responses")
+			}
+			if now.Before(responder.NotBefore) || now.After(responder.NotAfter) {
+				return nil, fmt.Errorf("ocsp responder certificate is expired or not yet valid")
+			}
+			signer = responder
+		}
+	}
+	if err := signer.CheckSignature(algo, basic.TBSResponseData.FullBytes, basic.Signature.RightAlign()); err != nil {
+		return nil, fmt.Errorf("ocsp response signature is not valid: %v", err)
+	}
+
+	for _, single := range data.Responses {
+		if !single.CertID.matches(leaf, issuer) {
+			continue
+		}
+		status := &RevocationStatus{
+			Source:     "ocsp",
+			ThisUpdate: single.ThisUpdate,
+			NextUpdate: single.NextUpdate,
+			Checked:    now,
+			Staple:     raw,
+		}
+		if !status.Fresh(now) {
+			return nil, fmt.Errorf("ocsp response is stale: thisUpdate %s, nextUpdate %s", single.ThisUpdate.Format(time.RFC3339), single.NextUpdate.Format(time.RFC3339))
+		}
+		switch {
+		case bool(single.Good):
+			status.Status = RevocationGood
+		case !single.Revoked.RevocationTime.IsZero():
+			status.Status = RevocationRevoked
+			status.RevokedAt = single.Revoked.RevocationTime
+			status.Reason = int(single.Revoked.Reason)
+		default:
+			status.Status = RevocationUnknown
+		}
+		return status, nil
+	}
+	return nil, fmt.Errorf("ocsp response does not cover serial %x of the issuer", leaf.SerialNumber)
+}
+
+// FetchOCSP asks the first OCSP responder of leaf for its status
+func FetchOCSP(httpClient *http.Client, leaf, issuer *x509.Certificate) (*RevocationStatus, error) {
+	if len(leaf.OCSPServer) == 0 {
+		return nil, fmt.Errorf("certificate has no ocsp responder")
+	}
+	req, err := CreateOCSPRequest(leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := clientOrDefault(httpClient).Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, fmt.Errorf("error requesting ocsp %s: %v", leaf.OCSPServer[0], err)
+	}
+	defer rsp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("error reading ocsp response: %v", err)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ocsp responder %s returned %s", leaf.OCSPServer[0], rsp.Status)
+	}
+	return ParseOCSPResponse(raw, leaf, issuer)
+}
+
+// FetchCRL looks leaf up in the first CRL distribution point of the certificate
+func FetchCRL(httpClient *http.Client, leaf, issuer *x509.Certificate) (*RevocationStatus, error) {
+	if len(leaf.CRLDistributionPoints) == 0 {
+		return nil, fmt.Errorf("certificate has no crl distribution point")
+	}
+	crlUrl := leaf.CRLDistributionPoints[0]
+	rsp, err := clientOrDefault(httpClient).Get(crlUrl)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching crl %s: %v", crlUrl, err)
+	}
+	defer rsp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(rsp.Body, 64<<20))
+	if err != nil {
+		return nil, fmt.Errorf("error reading crl: %v", err)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("crl %s returned %s", crlUrl, rsp.Status)
+	}
+	crl, err := x509.ParseRevocationList(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing crl %s: %v", crlUrl, err)
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("crl %s is not signed by the issuer: %v", crlUrl, err)
+	}
+	status := &RevocationStatus{
+		Status:     RevocationGood,
+		Source:     "crl",
+		ThisUpdate: crl.ThisUpdate,
+		NextUpdate: crl.NextUpdate,
+		Checked:    time.Now(),
+	}
+	// a stale crl may miss the revocation of the certificate
+	if !status.Fresh(status.Checked) {
+		return nil, fmt.Errorf("crl %s is stale: thisUpdate %s, nextUpdate %s", crlUrl, crl.ThisUpdate.Format(time.RFC3339), crl.NextUpdate.Format(time.RFC3339))
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+			status.Status = RevocationRevoked
+			status.RevokedAt = entry.RevocationTime
+			status.Reason = entry.ReasonCode
+			break
+		}
+	}
+	return status, nil
+}
+
+// CheckRevocation asks OCSP first and falls back to the CRL, as CAs like Let's Encrypt only publish CRLs
+func CheckRevocation(httpClient *http.Client, leaf, issuer *x509.Certificate) (*RevocationStatus, error) {
+	if issuer == nil {
+		return nil, fmt.Errorf("the issuer of the certificate is not in the chain")
+	}
+	status, ocspErr := FetchOCSP(httpClient, leaf, issuer)
+	if ocspErr == nil && status.Status != RevocationUnknown {
+		return status, nil
+	}
+	if len(leaf.CRLDistributionPoints) == 0 {
+		return status, ocspErr
+	}
+	crlStatus, err := FetchCRL(httpClient, leaf, issuer)
+	if err != nil {
+		if ocspErr == nil {
+			// the unknown ocsp status is still an answer
+			return status, nil
+		}
+		return nil, fmt.Errorf("%v; %v", ocspErr, err)
+	}
+	return crlStatus, nil
+}
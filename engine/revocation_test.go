@@ -0,0 +1,226 @@
+package engine_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+type testCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type testSingleResponse struct {
+	CertID     testCertID
+	Good       asn1.Flag `asn1:"tag:0,optional"`
+	ThisUpdate time.Time `asn1:"generalized"`
+	NextUpdate time.Time `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type testResponseData struct {
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []testSingleResponse
+}
+
+type testBasicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+}
+
+type testResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type testOCSPResponse struct {
+	Status   asn1.Enumerated
+	Response testResponseBytes `asn1:"explicit,tag:0"`
+}
+
+// testCertIDOf is the sha1 CertID of serial issued by issuer
+func testCertIDOf(t *testing.T, issuer *x509.Certificate, serial *big.Int) testCertID {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		t.Fatal(err)
+	}
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+	return testCertID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash[:],
+		IssuerKeyHash: keyHash[:],
+		SerialNumber:  serial,
+	}
+}
+
+// testOCSPResponder answers every request with a good status of serial, signed by the issuer
+func testOCSPResponder(t *testing.T, issuer *x509.Certificate, issuerKey *ecdsa.PrivateKey, serial *big.Int, now time.Time) []byte {
+	return signTestOCSP(t, issuer, issuerKey, testSingleResponse{
+		CertID:     testCertIDOf(t, issuer, serial),
+		Good:       true,
+		ThisUpdate: now.UTC().Truncate(time.Second),
+		NextUpdate: now.Add(4 * 24 * time.Hour).UTC().Truncate(time.Second),
+	})
+}
+
+// signTestOCSP signs a response of single by the issuer
+func signTestOCSP(t *testing.T, issuer *x509.Certificate, issuerKey *ecdsa.PrivateKey, single testSingleResponse) []byte {
+	data, err := asn1.Marshal(testResponseData{
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: issuer.RawSubject},
+		ProducedAt:  single.ThisUpdate,
+		Responses:   []testSingleResponse{single},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(data)
+	sig, err := issuerKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	basic, err := asn1.Marshal(testBasicResponse{
+		TBSResponseData:    asn1.RawValue{FullBytes: data},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+		Signature:          asn1.BitString{Bytes: sig, BitLength: len(sig) * 8},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := asn1.Marshal(testOCSPResponse{Response: testResponseBytes{
+		ResponseType: asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1},
+		Response:     basic,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// go test ./engine -v -run TestCheckRevocation
+func TestCheckRevocation(t *testing.T) {
+	now := time.Now()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	issuer := newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil, &caKey.PublicKey, caKey)
+
+	var ocspRaw, crlRaw []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ocsp" {
+			if r.Header.Get("Content-Type") != "application/ocsp-request" {
+				t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+			}
+			io.Copy(io.Discard, r.Body)
+			w.Write(ocspRaw)
+			return
+		}
+		w.Write(crlRaw)
+	}))
+	defer srv.Close()
+
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leaf := newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(42),
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(time.Hour),
+		DNSNames:              []string{"example.com"},
+		OCSPServer:            []string{srv.URL + "/ocsp"},
+		CRLDistributionPoints: []string{srv.URL + "/crl"},
+	}, issuer, &leafKey.PublicKey, caKey)
+
+	ocspRaw = testOCSPResponder(t, issuer, caKey, leaf.SerialNumber, now)
+	status, err := engine.CheckRevocation(nil, leaf, issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != engine.RevocationGood || status.Source != "ocsp" || len(status.Staple) == 0 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	if !status.RefreshAt().Equal(status.ThisUpdate.Add(2 * 24 * time.Hour)) {
+		t.Errorf("unexpected refresh time %s", status.RefreshAt())
+	}
+
+	// a response of another serial is not an answer, the crl is used
+	ocspRaw = testOCSPResponder(t, issuer, caKey, big.NewInt(7), now)
+	crlRaw, err = x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: now.Add(-time.Minute),
+		NextUpdate: now.Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: leaf.SerialNumber, RevocationTime: now.Add(-time.Minute), ReasonCode: 1},
+		},
+	}, issuer, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err = engine.CheckRevocation(nil, leaf, issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != engine.RevocationRevoked || status.Source != "crl" || status.Reason != 1 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	// an expired crl can't tell the certificate is good
+	crlRaw, err = x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(2),
+		ThisUpdate: now.Add(-2 * time.Hour),
+		NextUpdate: now.Add(-time.Hour),
+	}, issuer, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.FetchCRL(nil, leaf, issuer); err == nil {
+		t.Fatal("expected an error for an expired crl")
+	}
+
+	// a response for the serial of another issuer, or a stale one, is rejected
+	wrongIssuer := testCertIDOf(t, issuer, leaf.SerialNumber)
+	wrongIssuer.NameHash = make([]byte, len(wrongIssuer.NameHash))
+	raw := signTestOCSP(t, issuer, caKey, testSingleResponse{
+		CertID:     wrongIssuer,
+		Good:       true,
+		ThisUpdate: now.UTC().Truncate(time.Second),
+		NextUpdate: now.Add(time.Hour).UTC().Truncate(time.Second),
+	})
+	if _, err := engine.ParseOCSPResponse(raw, leaf, issuer); err == nil {
+		t.Fatal("expected an error for a response with a wrong issuer name hash")
+	}
+	raw = signTestOCSP(t, issuer, caKey, testSingleResponse{
+		CertID:     testCertIDOf(t, issuer, leaf.SerialNumber),
+		Good:       true,
+		ThisUpdate: now.Add(-2 * time.Hour).UTC().Truncate(time.Second),
+		NextUpdate: now.Add(-time.Hour).UTC().Truncate(time.Second),
+	})
+	if _, err := engine.ParseOCSPResponse(raw, leaf, issuer); err == nil {
+		t.Fatal("expected an error for an expired response")
+	}
+}
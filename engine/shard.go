@@ -0,0 +1,74 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Shard is one certificate of a domain list that is too large for a single order
+type Shard struct {
+	Index    int      `json:"index"`
+	Domains  []string `json:"domains"`
+	CertPath string   `json:"certPath"`
+	KeyPath  string   `json:"keyPath"`
+}
+
+// ShardPath inserts the shard index before the extension, e.g. cert.pem becomes cert-2.pem
+func ShardPath(path string, index int) string {
+	if path == "" {
+		return ""
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, ext), index, ext)
+}
+
+// PlanShards splits domains into shards of at most maxPerCert names.
+// Domains keep the shard they had in previous, so that the groupings are stable across renewals:
+// removed domains are dropped, new ones fill the shards with room in sorted order, then new shards.
+func PlanShards(domains DomainList, maxPerCert int, previous []Shard, certPath, keyPath string) []Shard {
+	wanted := make(map[string]bool)
+	for _, d := range domains {
+		wanted[d] = true
+	}
+
+	var shards []Shard
+	assigned := make(map[string]bool)
+	nextIndex := 1
+	for _, prev := range previous {
+		shard := Shard{Index: prev.Index, CertPath: ShardPath(certPath, prev.Index), KeyPath: ShardPath(keyPath, prev.Index)}
+		for _, d := range prev.Domains {
+			if wanted[d] && !assigned[d] && len(shard.Domains) < maxPerCert {
+				shard.Domains = append(shard.Domains, d)
+				assigned[d] = true
+			}
+		}
+		if prev.Index >= nextIndex {
+			nextIndex = prev.Index + 1
+		}
+		if len(shard.Domains) > 0 {
+			shards = append(shards, shard)
+		}
+	}
+
+	var pending []string
+	for _, d := range domains {
+		if !assigned[d] {
+			pending = append(pending, d)
+		}
+	}
+	sort.Strings(pending)
+	for _, d := range pending {
+		i := 0
+		for i < len(shards) && len(shards[i].Domains) >= maxPerCert {
+			i++
+		}
+		if i == len(shards) {
+			shards = append(shards, Shard{Index: nextIndex, CertPath: ShardPath(certPath, nextIndex), KeyPath: ShardPath(keyPath, nextIndex)})
+			nextIndex++
+		}
+		shards[i].Domains = append(shards[i].Domains, d)
+	}
+	return shards
+}
@@ -0,0 +1,26 @@
+package engine_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+// go test ./engine -v -run TestPlanShards
+func TestPlanShards(t *testing.T) {
+	domains := engine.DomainList{"e.com", "d.com", "c.com", "b.com", "a.com"}
+	shards := engine.PlanShards(domains, 2, nil, "/certs/cert.pem", "/certs/key.pem")
+	if len(shards) != 3 || !reflect.DeepEqual(shards[0].Domains, []string{"a.com", "b.com"}) || shards[2].CertPath != "/certs/cert-3.pem" {
+		t.Fatalf("unexpected shards: %+v", shards)
+	}
+
+	// b.com removed and f.com added: the other domains stay where they were
+	domains = engine.DomainList{"a.com", "c.com", "d.com", "e.com", "f.com"}
+	replanned := engine.PlanShards(domains, 2, shards, "/certs/cert.pem", "/certs/key.pem")
+	if !reflect.DeepEqual(replanned[0].Domains, []string{"a.com", "f.com"}) ||
+		!reflect.DeepEqual(replanned[1].Domains, shards[1].Domains) ||
+		!reflect.DeepEqual(replanned[2].Domains, shards[2].Domains) {
+		t.Fatalf("unexpected shards after change: %+v", replanned)
+	}
+}
@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/eggsampler/acme/v3"
+)
+
+// clockSkew tolerated between the CA and us when checking notBefore
+const clockSkew = 10 * time.Minute
+
+// VerifyOptions are the expectations a downloaded certificate chain is checked against
+type VerifyOptions struct {
+	// PublicKey of the private key (or csr) the certificate was requested with
+	PublicKey crypto.PublicKey
+	// Identifiers that the certificate must cover
+	Identifiers []acme.Identifier
+	// Roots the chain must build to, the system pool if nil
+	Roots *x509.CertPool
+	// Now is the time the validity is checked at, time.Now() if zero
+	Now time.Time
+}
+
+// VerifyChain checks a chain before it is deployed: the leaf matches the key, covers every identifier,
+// builds to a trusted root and is currently valid.
+func VerifyChain(certs []*x509.Certificate, opts VerifyOptions) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("certificate chain is empty")
+	}
+	leaf := certs[0]
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	if opts.PublicKey != nil {
+		pub, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+		if !ok || !pub.Equal(opts.PublicKey) {
+			return fmt.Errorf("certificate public key does not match the private key")
+		}
+	}
+
+	var missing []string
+	for _, id := range opts.Identifiers {
+		if !covers(leaf, id) {
+			missing = append(missing, id.Value)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("certificate does not cover %s", strings.Join(missing, ","))
+	}
+
+	if !leaf.NotAfter.After(leaf.NotBefore) {
+		return fmt.Errorf("certificate notAfter %s is not after notBefore %s", leaf.NotAfter, leaf.NotBefore)
+	}
+	if now.Add(clockSkew).Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate is not valid before %s", leaf.NotBefore)
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", leaf.NotAfter)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	// check the chain at a time the leaf is valid, even if notBefore is slightly ahead of our clock
+	verifyAt := now
+	if verifyAt.Before(leaf.NotBefore) {
+		verifyAt = leaf.NotBefore
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         opts.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   verifyAt,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}); err != nil {
+		return fmt.Errorf("certificate chain does not verify: %v", err)
+	}
+	return nil
+}
+
+func covers(leaf *x509.Certificate, id acme.Identifier) bool {
+	if id.Type == "ip" {
+		ip := net.ParseIP(id.Value)
+		for _, addr := range leaf.IPAddresses {
+			if addr.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, name := range leaf.DNSNames {
+		if strings.EqualFold(name, id.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// RootsFor loads the roots the chains of directoryUrl are verified against, before anything is ordered.
+// The roots of the Let's Encrypt staging CA are not publicly trusted: without a roots file every order
+// would fail at the verification, after it counted against the rate limits.
+func RootsFor(directoryUrl string, rootsFile string) (*x509.CertPool, error) {
+	if rootsFile == "" && directoryUrl == acme.LetsEncryptStaging {
+		return nil, fmt.Errorf("the roots of %s are not publicly trusted, a trusted roots file is required (https://letsencrypt.org/docs/staging-environment/)", directoryUrl)
+	}
+	return LoadRoots(rootsFile)
+}
+
+// LoadRoots reads a pem bundle of trusted roots, an empty path returns nil for the system pool
+func LoadRoots(rootsFile string) (*x509.CertPool, error) {
+	if rootsFile == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(rootsFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading roots file %q: %v", rootsFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("no certificate found in roots file %q", rootsFile)
+	}
+	return pool, nil
+}
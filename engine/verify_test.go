@@ -0,0 +1,74 @@
+package engine_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/eggsampler/acme/v3"
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+func newTestCert(t *testing.T, tpl *x509.Certificate, parent *x509.Certificate, pub *ecdsa.PublicKey, signer *ecdsa.PrivateKey) *x509.Certificate {
+	if parent == nil {
+		parent = tpl
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, pub, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// go test ./engine -v -run TestVerifyChain
+func TestVerifyChain(t *testing.T) {
+	now := time.Now()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	root := newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, &caKey.PublicKey, caKey)
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leaf := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(time.Hour),
+		DNSNames:     []string{"example.com", "*.example.com"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, root, &leafKey.PublicKey, caKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	ids := []acme.Identifier{{Type: "dns", Value: "example.com"}, {Type: "dns", Value: "*.example.com"}}
+	opts := engine.VerifyOptions{PublicKey: &leafKey.PublicKey, Identifiers: ids, Roots: roots}
+	if err := engine.VerifyChain([]*x509.Certificate{leaf}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	bad := []engine.VerifyOptions{
+		{PublicKey: &otherKey.PublicKey, Identifiers: ids, Roots: roots},
+		{PublicKey: &leafKey.PublicKey, Identifiers: append(ids, acme.Identifier{Type: "ip", Value: "192.0.2.1"}), Roots: roots},
+		{PublicKey: &leafKey.PublicKey, Identifiers: ids, Roots: x509.NewCertPool()},
+		{PublicKey: &leafKey.PublicKey, Identifiers: ids, Roots: roots, Now: now.Add(2 * time.Hour)},
+	}
+	for i, opts := range bad {
+		if err := engine.VerifyChain([]*x509.Certificate{leaf}, opts); err == nil {
+			t.Errorf("case %d: expected an error", i)
+		}
+	}
+}
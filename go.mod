@@ -7,4 +7,7 @@ toolchain go1.21.3
 require (
 	github.com/bddjr/hlfhr v0.2.3
 	github.com/eggsampler/acme/v3 v3.6.1
+	golang.org/x/net v0.21.0
 )
+
+require golang.org/x/text v0.14.0 // indirect
@@ -0,0 +1,166 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout of a request when Options.Timeout is empty
+const DefaultTimeout = 30 * time.Second
+
+// Options of the http clients used for the acme CA, the dns providers and oauth
+type Options struct {
+	// CABundle is a pem file of roots trusted in addition to the system roots, e.g. of a private CA like step-ca
+	CABundle string `json:"caBundle,omitempty"`
+	// Proxy url, http://, https:// or socks5://
+	Proxy string `json:"proxy,omitempty"`
+	// Timeout of a request, e.g. "30s"
+	Timeout string `json:"timeout,omitempty"`
+	// UserAgent sent with every request
+	UserAgent string `json:"userAgent,omitempty"`
+}
+
+// Merge returns opts with the empty fields taken from defaults
+func (opts Options) Merge(defaults Options) Options {
+	if opts.CABundle == "" {
+		opts.CABundle = defaults.CABundle
+	}
+	if opts.Proxy == "" {
+		opts.Proxy = defaults.Proxy
+	}
+	if opts.Timeout == "" {
+		opts.Timeout = defaults.Timeout
+	}
+	if opts.UserAgent == "" {
+		opts.UserAgent = defaults.UserAgent
+	}
+	return opts
+}
+
+// Validate checks the options without building a client
+func (opts Options) Validate() error {
+	_, err := New(opts)
+	return err
+}
+
+// New builds a http client from opts
+func New(opts Options) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.Proxy != "" {
+		proxyUrl, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxy url %q is not valid: %v", opts.Proxy, err)
+		}
+		switch proxyUrl.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("proxy scheme %q is not supported, use http, https or socks5", proxyUrl.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+	if opts.CABundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		raw, err := os.ReadFile(opts.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ca bundle %q: %v", opts.CABundle, err)
+		}
+		if !pool.AppendCertsFromPEM(raw) {
+			return nil, fmt.Errorf("no certificate found in ca bundle %q", opts.CABundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	timeout := DefaultTimeout
+	if opts.Timeout != "" {
+		d, err := time.ParseDuration(opts.Timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("timeout %q is not a valid duration", opts.Timeout)
+		}
+		timeout = d
+	}
+	var rt http.RoundTripper = transport
+	if opts.UserAgent != "" {
+		rt = &userAgentTransport{userAgent: opts.UserAgent, next: transport}
+	}
+	return &http.Client{Transport: rt, Timeout: timeout}, nil
+}
+
+// userAgentTransport sets the user agent of requests that have none
+type userAgentTransport struct {
+	userAgent string
+	next      http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.next.RoundTrip(req)
+}
+
+var (
+	defaultOptions Options
+	defaultClient  = &http.Client{Timeout: DefaultTimeout}
+	defaultMu      sync.RWMutex
+	// clients caches the clients of For by their merged options, so their connections are reused
+	clients   = make(map[Options]*http.Client)
+	clientsMu sync.Mutex
+)
+
+// SetDefault sets the options of the default client, the base of every per-config client
+func SetDefault(opts Options) error {
+	client, err := New(opts)
+	if err != nil {
+		return err
+	}
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultOptions = opts
+	defaultClient = client
+	clientsMu.Lock()
+	clients = make(map[Options]*http.Client)
+	clientsMu.Unlock()
+	return nil
+}
+
+// DefaultOptions returns the options of the default client
+func DefaultOptions() Options {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultOptions
+}
+
+// Default returns the default client
+func Default() *http.Client {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultClient
+}
+
+// For returns the client of opts, merged with the default options. Without own options it is the default client.
+func For(opts Options) (*http.Client, error) {
+	if opts == (Options{}) {
+		return Default(), nil
+	}
+	merged := opts.Merge(DefaultOptions())
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if client, ok := clients[merged]; ok {
+		return client, nil
+	}
+	client, err := New(merged)
+	if err != nil {
+		return nil, err
+	}
+	clients[merged] = client
+	return client, nil
+}
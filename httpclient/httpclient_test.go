@@ -0,0 +1,57 @@
+package httpclient_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nicennnnnnnlee/cert_bot/httpclient"
+)
+
+// go test ./httpclient -v -run TestNew
+func TestNew(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.UserAgent())
+	}))
+	defer srv.Close()
+
+	client, err := httpclient.New(httpclient.Options{UserAgent: "cert_bot-test", Timeout: "5s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if body, _ := io.ReadAll(rsp.Body); string(body) != "cert_bot-test" {
+		t.Fatalf("unexpected user agent %q", body)
+	}
+
+	for _, opts := range []httpclient.Options{
+		{Proxy: "ftp://proxy:21"},
+		{Timeout: "soon"},
+		{CABundle: "/nonexistent/ca.pem"},
+	} {
+		if _, err := httpclient.New(opts); err == nil {
+			t.Errorf("expected an error for %+v", opts)
+		}
+	}
+}
+
+// go test ./httpclient -v -run TestFor
+func TestFor(t *testing.T) {
+	a, err := httpclient.For(httpclient.Options{UserAgent: "cert_bot-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := httpclient.For(httpclient.Options{UserAgent: "cert_bot-test"})
+	c, _ := httpclient.For(httpclient.Options{UserAgent: "cert_bot-other"})
+	if a != b || a == c {
+		t.Fatal("clients of equal options should be shared, others not")
+	}
+	if def, _ := httpclient.For(httpclient.Options{}); def != httpclient.Default() {
+		t.Fatal("empty options should use the default client")
+	}
+}
@@ -0,0 +1,411 @@
+package idp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nicennnnnnnlee/cert_bot/httpclient"
+)
+
+// Identity is the user a provider logged in
+type Identity struct {
+	User   string
+	Email  string
+	Groups []string
+	// Claims are the merged id token and userinfo claims, or the user of the GitHub API
+	Claims map[string]interface{}
+}
+
+// Provider is an identity provider with the authorization code flow and PKCE
+type Provider interface {
+	// AuthCodeURL returns the url the user is redirected to for login, redirectURI may be empty for the registered one
+	AuthCodeURL(state, nonce, codeVerifier, redirectURI string) (string, error)
+	// Exchange trades the code of the callback for the identity of the user
+	Exchange(code, codeVerifier, nonce, redirectURI string) (*Identity, error)
+}
+
+// Config of a provider, the empty fields take the defaults of the preset
+type Config struct {
+	// Provider is the preset: github, gitlab, gitea or oidc
+	Provider string
+	// Issuer of oidc, or the base url of a self-hosted GitHub Enterprise, GitLab or Gitea
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	Scopes       []string
+	// UserClaim is the claim of the user name, GroupsClaim the claim of the groups
+	UserClaim   string
+	GroupsClaim string
+	// Groups asks for the groups of the user, the github preset then requests read:org and the organizations
+	Groups bool
+	// HTTPClient defaults to httpclient.Default()
+	HTTPClient *http.Client
+}
+
+// Presets of the supported providers
+var Presets = map[string]Config{
+	"github": {Issuer: "https://github.com", UserClaim: "login"},
+	"gitlab": {Issuer: "https://gitlab.com", Scopes: []string{"openid", "profile", "email"}, UserClaim: "nickname", GroupsClaim: "groups"},
+	"gitea":  {Issuer: "https://gitea.com", Scopes: []string{"openid", "profile", "email", "groups"}, UserClaim: "preferred_username", GroupsClaim: "groups"},
+	"oidc":   {Scopes: []string{"openid", "profile", "email"}, UserClaim: "preferred_username", GroupsClaim: "groups"},
+}
+
+// New creates the provider of conf, oidc endpoints are discovered on first use
+func New(conf Config) (Provider, error) {
+	preset, ok := Presets[conf.Provider]
+	if !ok {
+		return nil, fmt.Errorf("provider %q is not supported, use github, gitlab, gitea or oidc", conf.Provider)
+	}
+	if conf.Issuer == "" {
+		conf.Issuer = preset.Issuer
+	}
+	conf.Issuer = strings.TrimSuffix(conf.Issuer, "/")
+	if len(conf.Scopes) == 0 {
+		conf.Scopes = preset.Scopes
+	}
+	if conf.UserClaim == "" {
+		conf.UserClaim = preset.UserClaim
+	}
+	if conf.GroupsClaim == "" {
+		conf.GroupsClaim = preset.GroupsClaim
+	}
+	if conf.Issuer == "" {
+		return nil, fmt.Errorf("the issuer of provider %s should be set", conf.Provider)
+	}
+	if conf.ClientId == "" {
+		return nil, fmt.Errorf("the client id should be set")
+	}
+	if conf.Provider == "github" {
+		if conf.Groups && !slices.Contains(conf.Scopes, "read:org") {
+			conf.Scopes = append(slices.Clone(conf.Scopes), "read:org")
+		}
+		return &githubProvider{conf: conf}, nil
+	}
+	if !slices.Contains(conf.Scopes, "openid") {
+		conf.Scopes = append([]string{"openid"}, conf.Scopes...)
+	}
+	return &oidcProvider{conf: conf}, nil
+}
+
+func (conf Config) client() *http.Client {
+	if conf.HTTPClient != nil {
+		return conf.HTTPClient
+	}
+	return httpclient.Default()
+}
+
+// NewCodeVerifier creates a random PKCE code verifier, also usable as state or nonce
+func NewCodeVerifier() string {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// CodeChallenge is the S256 PKCE challenge of codeVerifier
+func CodeChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func authCodeURL(endpoint string, conf Config, state, nonce, codeVerifier, redirectURI string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("authorization endpoint %q is not valid: %v", endpoint, err)
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", conf.ClientId)
+	q.Set("state", state)
+	q.Set("code_challenge", CodeChallenge(codeVerifier))
+	q.Set("code_challenge_method", "S256")
+	if len(conf.Scopes) > 0 {
+		q.Set("scope", strings.Join(conf.Scopes, " "))
+	}
+	if nonce != "" {
+		q.Set("nonce", nonce)
+	}
+	if redirectURI != "" {
+		q.Set("redirect_uri", redirectURI)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IdToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// exchangeCode posts the code and the code verifier to the token endpoint
+func exchangeCode(endpoint string, conf Config, code, codeVerifier, redirectURI string) (*tokenResponse, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"client_id":     {conf.ClientId},
+		"client_secret": {conf.ClientSecret},
+		"code_verifier": {codeVerifier},
+	}
+	if redirectURI != "" {
+		form.Set("redirect_uri", redirectURI)
+	}
+	req, _ := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	var token tokenResponse
+	if err := doJSON(conf.client(), req, &token); err != nil && token.Error == "" {
+		return nil, fmt.Errorf("error exchanging the code: %v", err)
+	}
+	if token.Error != "" {
+		return nil, fmt.Errorf("error exchanging the code: %s %s", token.Error, token.ErrorDescription)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("no access_token in the token response")
+	}
+	return &token, nil
+}
+
+// getJSON gets url with the access token
+func getJSON(client *http.Client, url string, accessToken string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	return doJSON(client, req, v)
+}
+
+func doJSON(client *http.Client, req *http.Request, v interface{}) error {
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	// the body of an error may still carry an oauth error
+	jsonErr := json.Unmarshal(body, v)
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", req.URL.Redacted(), rsp.Status)
+	}
+	if jsonErr != nil {
+		return fmt.Errorf("error parsing the response of %s: %v", req.URL.Redacted(), jsonErr)
+	}
+	return nil
+}
+
+// stringClaim returns a string claim, numbers like the GitHub id are formatted
+func stringClaim(claims map[string]interface{}, name string) string {
+	switch v := claims[name].(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprintf("%.0f", v)
+	}
+	return ""
+}
+
+// listClaim returns a claim that is a list of strings or a single string
+func listClaim(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func identityOf(conf Config, claims map[string]interface{}) (*Identity, error) {
+	id := &Identity{
+		User:   stringClaim(claims, conf.UserClaim),
+		Email:  stringClaim(claims, "email"),
+		Claims: claims,
+	}
+	if conf.GroupsClaim != "" {
+		id.Groups = listClaim(claims, conf.GroupsClaim)
+	}
+	if id.User == "" {
+		return nil, fmt.Errorf("no %q claim of the user", conf.UserClaim)
+	}
+	return id, nil
+}
+
+// oidcProvider is a OpenID Connect provider found by discovery, e.g. Keycloak, GitLab or Gitea
+type oidcProvider struct {
+	conf      Config
+	mu        sync.Mutex
+	discovery *discovery
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// discover fetches the configuration of the issuer once, a failed discovery is tried again on the next login
+func (p *oidcProvider) discover() (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var d discovery
+	if err := getJSON(p.conf.client(), p.conf.Issuer+"/.well-known/openid-configuration", "", &d); err != nil {
+		return nil, fmt.Errorf("error discovering %s: %v", p.conf.Issuer, err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.conf.Issuer {
+		return nil, fmt.Errorf("discovered issuer %q does not match %q", d.Issuer, p.conf.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" {
+		return nil, fmt.Errorf("the configuration of %s has no authorization or token endpoint", p.conf.Issuer)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+func (p *oidcProvider) AuthCodeURL(state, nonce, codeVerifier, redirectURI string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	return authCodeURL(d.AuthorizationEndpoint, p.conf, state, nonce, codeVerifier, redirectURI)
+}
+
+func (p *oidcProvider) Exchange(code, codeVerifier, nonce, redirectURI string) (*Identity, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	token, err := exchangeCode(d.TokenEndpoint, p.conf, code, codeVerifier, redirectURI)
+	if err != nil {
+		return nil, err
+	}
+	claims := make(map[string]interface{})
+	if token.IdToken != "" {
+		if claims, err = p.idTokenClaims(d, token.IdToken, nonce); err != nil {
+			return nil, err
+		}
+	}
+	if d.UserinfoEndpoint != "" {
+		userinfo := make(map[string]interface{})
+		if err := getJSON(p.conf.client(), d.UserinfoEndpoint, token.AccessToken, &userinfo); err != nil {
+			return nil, fmt.Errorf("error fetching userinfo: %v", err)
+		}
+		if sub, ok := claims["sub"]; ok && userinfo["sub"] != sub {
+			return nil, fmt.Errorf("the subject of userinfo does not match the id token")
+		}
+		for k, v := range userinfo {
+			claims[k] = v
+		}
+	}
+	if len(claims) == 0 {
+		return nil, fmt.Errorf("the provider returned neither an id token nor userinfo")
+	}
+	return identityOf(p.conf, claims)
+}
+
+// idTokenClaims checks the issuer, audience, expiry and nonce of the id token. The id token comes
+// directly from the token endpoint over TLS, which validates the issuer instead of the signature (OIDC Core 3.1.3.7)
+func (p *oidcProvider) idTokenClaims(d *discovery, idToken string, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("id token is not a jwt")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("error decoding id token: %v", err)
+	}
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("error parsing id token: %v", err)
+	}
+	if iss := stringClaim(claims, "iss"); iss != d.Issuer {
+		return nil, fmt.Errorf("id token issuer %q does not match %q", iss, d.Issuer)
+	}
+	audienceOk := false
+	for _, aud := range listClaim(claims, "aud") {
+		audienceOk = audienceOk || aud == p.conf.ClientId
+	}
+	if !audienceOk {
+		return nil, fmt.Errorf("id token is not issued to client %s", p.conf.ClientId)
+	}
+	if exp, ok := claims["exp"].(float64); !ok || time.Now().After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("id token is expired")
+	}
+	if nonce != "" && stringClaim(claims, "nonce") != nonce {
+		return nil, fmt.Errorf("id token nonce does not match")
+	}
+	return claims, nil
+}
+
+// githubProvider is GitHub or GitHub Enterprise, which has no OIDC login. The organizations of the user are its groups.
+type githubProvider struct {
+	conf Config
+}
+
+func (p *githubProvider) apiURL() string {
+	if p.conf.Issuer == "https://github.com" {
+		return "https://api.github.com"
+	}
+	return p.conf.Issuer + "/api/v3"
+}
+
+func (p *githubProvider) AuthCodeURL(state, nonce, codeVerifier, redirectURI string) (string, error) {
+	return authCodeURL(p.conf.Issuer+"/login/oauth/authorize", p.conf, state, "", codeVerifier, redirectURI)
+}
+
+func (p *githubProvider) Exchange(code, codeVerifier, nonce, redirectURI string) (*Identity, error) {
+	token, err := exchangeCode(p.conf.Issuer+"/login/oauth/access_token", p.conf, code, codeVerifier, redirectURI)
+	if err != nil {
+		return nil, err
+	}
+	client := p.conf.client()
+	user := make(map[string]interface{})
+	if err := getJSON(client, p.apiURL()+"/user", token.AccessToken, &user); err != nil {
+		return nil, fmt.Errorf("error fetching the user: %v", err)
+	}
+	id, err := identityOf(p.conf, user)
+	if err != nil {
+		return nil, err
+	}
+	if !p.conf.Groups {
+		return id, nil
+	}
+	var orgs []struct {
+		Login string `json:"login"`
+	}
+	if err := getJSON(client, p.apiURL()+"/user/orgs", token.AccessToken, &orgs); err != nil {
+		return nil, fmt.Errorf("error fetching the organizations of the user: %v", err)
+	}
+	for _, org := range orgs {
+		id.Groups = append(id.Groups, org.Login)
+	}
+	return id, nil
+}
@@ -0,0 +1,122 @@
+package idp_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicennnnnnnlee/cert_bot/idp"
+)
+
+// standInProvider is a minimal OIDC provider: discovery, a token endpoint checking PKCE, and userinfo
+type standInProvider struct {
+	*httptest.Server
+	challenge string
+	nonce     string
+}
+
+func newStandInProvider(t *testing.T) *standInProvider {
+	p := &standInProvider{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"userinfo_endpoint":      p.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "the-code" || idp.CodeChallenge(r.Form.Get("code_verifier")) != p.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims, _ := json.Marshal(map[string]interface{}{
+			"iss":   p.URL,
+			"aud":   "client",
+			"sub":   "42",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": p.nonce,
+		})
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "the-access-token",
+			"id_token":     "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".sig",
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer the-access-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sub":                "42",
+			"preferred_username": "alice",
+			"email":              "alice@example.com",
+			"groups":             []string{"ops", "dev"},
+		})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// go test ./idp -v -run TestOIDCLogin
+func TestOIDCLogin(t *testing.T) {
+	p := newStandInProvider(t)
+	provider, err := idp.New(idp.Config{Provider: "oidc", Issuer: p.URL, ClientId: "client", ClientSecret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := idp.NewCodeVerifier()
+	authURL, err := provider.AuthCodeURL("the-state", "the-nonce", verifier, "https://example.com/xx/api/oauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(authURL)
+	q := u.Query()
+	if !strings.HasPrefix(authURL, p.URL+"/authorize?") || q.Get("state") != "the-state" ||
+		q.Get("code_challenge_method") != "S256" || q.Get("scope") != "openid profile email" {
+		t.Fatalf("unexpected auth url %s", authURL)
+	}
+	p.challenge, p.nonce = q.Get("code_challenge"), q.Get("nonce")
+
+	id, err := provider.Exchange("the-code", verifier, "the-nonce", "https://example.com/xx/api/oauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.User != "alice" || id.Email != "alice@example.com" || strings.Join(id.Groups, ",") != "ops,dev" {
+		t.Fatalf("unexpected identity %+v", id)
+	}
+
+	if _, err := provider.Exchange("the-code", idp.NewCodeVerifier(), "the-nonce", ""); err == nil {
+		t.Error("expected an error for a wrong code verifier")
+	}
+	if _, err := provider.Exchange("the-code", verifier, "another-nonce", ""); err == nil {
+		t.Error("expected an error for a wrong nonce")
+	}
+}
+
+// go test ./idp -v -run TestGitHubScopes
+func TestGitHubScopes(t *testing.T) {
+	for _, groups := range []bool{false, true} {
+		provider, err := idp.New(idp.Config{Provider: "github", ClientId: "client", Groups: groups})
+		if err != nil {
+			t.Fatal(err)
+		}
+		authURL, err := provider.AuthCodeURL("the-state", "", idp.NewCodeVerifier(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, _ := url.Parse(authURL)
+		if scope := u.Query().Get("scope"); (scope == "read:org") != groups {
+			t.Fatalf("unexpected scope %q with groups %v", scope, groups)
+		}
+	}
+}
@@ -6,18 +6,13 @@ import (
 	"crypto/elliptic"
 	"crypto/md5"
 	"crypto/rand"
-	"crypto/sha1"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"log"
-	mrand "math/rand"
 	"net"
-	"net/http"
-	"net/url"
 	"strings"
-	"time"
 
 	"github.com/eggsampler/acme/v3"
 )
@@ -27,7 +22,7 @@ func checkTxtRecord(identifier, expectedValue string) error {
 	resolver := &net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			return dialer.DialContext(ctx, "udp", "1.1.1.1:53")
+			return dialer.DialContext(ctx, "udp", dnsServer)
 		},
 	}
 	txts, err := resolver.LookupTXT(context.Background(), "_acme-challenge."+identifier)
@@ -46,16 +41,34 @@ func checkTxtRecord(identifier, expectedValue string) error {
 	return fmt.Errorf("expected %s, found %s", expectedValue, txts)
 }
 
-func createAccount(client acme.Client, aconfig *AcmeConfig) (acme.Account, error) {
+func createAccount(client acme.Client, aconfig *AcmeConfig, directoryUrl string) (acme.Account, error) {
 	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return acme.Account{}, fmt.Errorf("error creating private key: %v", err)
 	}
 	account, err := client.NewAccount(privKey, false, true)
 	if err != nil {
-		return acme.Account{}, fmt.Errorf("error creating new account: %v", err)
+		return acme.Account{}, fmt.Errorf("error creating new account: %w", err)
+	}
+	aconfig.setAccount(directoryUrl, &Account{PrivateKey: string(key2pem(privKey)), Url: account.URL})
+	return account, nil
+}
+
+// loadAccount updates the account of the CA, or creates one if the config has none for it yet
+func loadAccount(client acme.Client, aconfig *AcmeConfig, directoryUrl string, Fprintf func(format string, a ...any)) (acme.Account, error) {
+	if acc := aconfig.lockedAccount(directoryUrl); acc != nil {
+		Fprintf("Updating existing account: %s", aconfig.Domains)
+		account, err := client.UpdateAccount(acme.Account{PrivateKey: pem2key([]byte(acc.PrivateKey)), URL: acc.Url})
+		if err != nil {
+			return acme.Account{}, fmt.Errorf("error updating existing account: %w", err)
+		}
+		return account, nil
+	}
+	Fprintf("Creating new account: %s", aconfig.Domains)
+	account, err := createAccount(client, aconfig, directoryUrl)
+	if err != nil {
+		return acme.Account{}, fmt.Errorf("error creaing new account: %w", err)
 	}
-	aconfig.Account = &Account{PrivateKey: string(key2pem(privKey)), Url: account.URL}
 	return account, nil
 }
 
@@ -80,38 +93,10 @@ func pem2key(data []byte) *ecdsa.PrivateKey {
 	return key
 }
 
-func initProxyUrl(proxyURL string) {
-	if proxyURL != "" {
-		proxyUrl, err := url.Parse(proxyURL)
-		if err != nil {
-			log.Println("proxy url is not valid: ", proxyURL)
-		} else {
-			http.DefaultClient.Transport = &http.Transport{
-				Proxy: http.ProxyURL(proxyUrl),
-			}
-		}
-	}
-}
-
 func HashMd5(raw string) string {
 	hash := md5.Sum([]byte(raw))
 	return hex.EncodeToString(hash[:])
 }
-func HashSHA1(raw string) string {
-	hash := sha1.Sum([]byte(raw))
-	return hex.EncodeToString(hash[:])
-}
-
-func RandomString(length int) string {
-	mrand.Seed(time.Now().UnixNano())
-	const letters = `abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789~!@#$%^&*()_+-=[]\{}|;':",./<>?`
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = letters[mrand.Intn(len(letters))]
-	}
-	return string(b)
-}
-
 func splitHostPort(hostPort string) (host, port string) {
 	host = hostPort
 	colon := strings.LastIndexByte(host, ':')
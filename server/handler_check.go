@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/eggsampler/acme/v3"
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+// CheckResult 是一个CA的检查结果
+type CheckResult struct {
+	DirectoryUrl string                  `json:"directoryUrl"`
+	Report       *engine.PreflightReport `json:"report,omitempty"`
+	Err          string                  `json:"err,omitempty"`
+}
+
+// preflight 在下单前检查 CAA 记录是否允许该CA签发, 以及 http-01/tls-alpn-01 的域名是否有 A/AAAA 记录
+func (aconfig *AcmeConfig) preflight(directoryUrl string, accountUrl string, ids []acme.Identifier) (*engine.PreflightReport, error) {
+	httpClient, err := aconfig.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := engine.FetchDirectory(httpClient, directoryUrl)
+	if err != nil {
+		return nil, err
+	}
+	return engine.Preflight(ids, engine.PreflightOptions{
+		DNSServer:     dnsServer,
+		CAIdentities:  dir.Meta.CaaIdentities,
+		AccountURI:    accountUrl,
+		ChallengeType: aconfig.challengeType,
+	}), nil
+}
+
+// handleCheck 对配置的每个CA运行下单前的检查
+func handleCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !requestAllows(r, r.URL.Query().Get("id")) {
+		writeAuthError(w, http.StatusForbidden, 4013, "The token is not allowed to access this config")
+		return
+	}
+	conf := getAcmeConfig(r.URL.Query().Get("id"))
+	if conf == nil {
+		w.Write([]byte("{\"err\": 4000,\"msg\": \"No id matched!!!\"}"))
+		return
+	}
+	ids, err := conf.identifiers()
+	if err != nil {
+		bytes, _ := json.Marshal(&HttpResult{Err: 4003, Data: err.Error()})
+		w.Write(bytes)
+		return
+	}
+	var results []CheckResult
+	for _, directoryUrl := range conf.directoryUrls() {
+		result := CheckResult{DirectoryUrl: directoryUrl}
+		var accountUrl string
+		if account := conf.lockedAccount(directoryUrl); account != nil {
+			accountUrl = account.Url
+		}
+		result.Report, err = conf.preflight(directoryUrl, accountUrl, ids)
+		if err != nil {
+			result.Err = err.Error()
+		}
+		results = append(results, result)
+	}
+	bytes, _ := json.Marshal(&HttpResult{Err: 2000, Data: results})
+	w.Write(bytes)
+}
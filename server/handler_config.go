@@ -2,15 +2,41 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/eggsampler/acme/v3"
 	"github.com/nicennnnnnnlee/cert_bot/dns01"
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+	"github.com/nicennnnnnnlee/cert_bot/httpclient"
 )
 
-var AcmeConfigs = make(map[string]*AcmeConfig)
+var (
+	AcmeConfigs = make(map[string]*AcmeConfig)
+	configsMu   sync.RWMutex
+)
+
+func getAcmeConfig(id string) *AcmeConfig {
+	configsMu.RLock()
+	defer configsMu.RUnlock()
+	return AcmeConfigs[id]
+}
+
+// listAcmeConfigs 返回所有配置的快照, 用于后台任务遍历
+func listAcmeConfigs() []*AcmeConfig {
+	configsMu.RLock()
+	defer configsMu.RUnlock()
+	var confs []*AcmeConfig
+	for _, conf := range AcmeConfigs {
+		confs = append(confs, conf)
+	}
+	return confs
+}
 
 type NotEmptyString string
 
@@ -27,13 +53,183 @@ func (nes *NotEmptyString) UnmarshalJSON(data []byte) error {
 }
 
 type AcmeConfig struct {
-	Id           string              `json:"id"`
-	DirectoryUrl string              `json:"directoryUrl"`
-	Domains      string              `json:"domains"`
-	Account      *Account            `json:"account"`
-	Dns01        *dns01.DNS01Setting `json:"dns01"`
-	CertPath     string              `json:"certPath"`
-	KeyPath      string              `json:"keyPath"`
+	Id           string `json:"id"`
+	DirectoryUrl string `json:"directoryUrl"`
+	Domains      string `json:"domains"`
+	// 旧版本保存的账户, 加载时移到 Accounts
+	Account  *Account            `json:"account,omitempty"`
+	Dns01    *dns01.DNS01Setting `json:"dns01"`
+	CertPath string              `json:"certPath"`
+	KeyPath  string              `json:"keyPath"`
+	// 备用CA, 当前一个CA限流或服务异常时按顺序尝试下一个
+	FallbackDirectoryUrls []string `json:"fallbackDirectoryUrls,omitempty"`
+	// 每个CA的账户, key 为 directory url, 修改或调整 directory url 的顺序后不会用错其它CA的账户
+	Accounts map[string]*Account `json:"accounts,omitempty"`
+	// 优先选择的证书链, 根证书的 CommonName, 如 "ISRG Root X1"
+	PreferredChain string `json:"preferredChain,omitempty"`
+	// 证书 profile, 如 "shortlived", "tlsserver", 须是CA在 directory 中声明的
+	Profile string `json:"profile,omitempty"`
+	// PEM 格式的 CSR, 设置后 identifiers 取自 CSR 的 SANs, 按原样 finalize, 不生成也不写入私钥
+	Csr string `json:"csr,omitempty"`
+	// 生成 CSR 的选项: commonName/noCommonName, mustStaple, 及其它 subject 字段
+	CsrOptions engine.CSROptions `json:"csrOptions"`
+	// 证书有效期, RFC 3339 时间或相对现在的时长如 "168h", 仅部分CA支持
+	NotBefore string `json:"notBefore,omitempty"`
+	NotAfter  string `json:"notAfter,omitempty"`
+	// 每张证书最多的域名数, 大于0时把 Domains 拆分成多张证书, 如 Let's Encrypt 的上限 100
+	MaxNamesPerCert int `json:"maxNamesPerCert,omitempty"`
+	// 拆分结果, 保存时生成, 已有的分组在续期和修改 Domains 后保持不变
+	Shards []engine.Shard `json:"shards,omitempty"`
+	// PEM 格式的根证书文件, 签发的证书链须能验证到其中的根证书, 为空时使用系统根证书
+	TrustedRootsFile string `json:"trustedRootsFile,omitempty"`
+	// 访问CA和DNS服务商时的 http 选项: caBundle, proxy, timeout, userAgent, 未设置时使用全局的默认值
+	Http httpclient.Options `json:"http"`
+	// 跳过申请前的 CAA 和 DNS 检查
+	SkipChecks bool `json:"skipChecks,omitempty"`
+	// 证书与 Domains 不一致时, 等待 /api/approve 确认后才重新签发
+	ReissueNeedsApproval bool `json:"reissueNeedsApproval,omitempty"`
+	// 证书状态, 查询时根据 CertPath 生成, 不需要设置
+	Status *CertStatus `json:"status,omitempty"`
+
+	reissuePending bool
+	// 域名使用的验证方式, 为空时根据 Dns01 选择, 用于服务自身的证书
+	challenge string
+}
+
+// directoryUrls 返回按顺序尝试的CA列表, 支持预设名称如 letsencrypt, zerossl
+func (aconfig *AcmeConfig) directoryUrls() []string {
+	return engine.DirectoryUrls(append([]string{aconfig.DirectoryUrl}, aconfig.FallbackDirectoryUrls...)...)
+}
+
+// validate 检查配置并规范化 Domains, 返回每个字段的错误
+func (aconfig *AcmeConfig) validate() map[string]interface{} {
+	fieldErrs := make(map[string]interface{})
+	if aconfig.Csr != "" {
+		if _, err := engine.ParseCSR([]byte(aconfig.Csr)); err != nil {
+			fieldErrs["csr"] = err.Error()
+		}
+	} else {
+		domains, err := engine.ParseDomainList(aconfig.Domains)
+		var listErr *engine.DomainListError
+		if errors.As(err, &listErr) {
+			fieldErrs["domains"] = listErr.Entries
+		} else if err != nil {
+			fieldErrs["domains"] = err.Error()
+		} else {
+			aconfig.Domains = domains.String()
+		}
+	}
+	if aconfig.MaxNamesPerCert < 0 {
+		fieldErrs["maxNamesPerCert"] = "should not be negative"
+	} else if aconfig.MaxNamesPerCert > 0 && aconfig.Csr != "" {
+		fieldErrs["maxNamesPerCert"] = "can not split the names of an uploaded csr"
+	}
+	if err := aconfig.Http.Merge(httpclient.DefaultOptions()).Validate(); err != nil {
+		fieldErrs["http"] = err.Error()
+	}
+	now := time.Now()
+	if _, err := engine.ParseOrderTime(aconfig.NotBefore, now); err != nil {
+		fieldErrs["notBefore"] = err.Error()
+	}
+	if _, err := engine.ParseOrderTime(aconfig.NotAfter, now); err != nil {
+		fieldErrs["notAfter"] = err.Error()
+	}
+	return fieldErrs
+}
+
+// identifiers 返回要申请的 identifiers, 上传了 CSR 时取自其 SANs
+func (aconfig *AcmeConfig) identifiers() ([]acme.Identifier, error) {
+	if aconfig.Csr != "" {
+		csr, err := engine.ParseCSR([]byte(aconfig.Csr))
+		if err != nil {
+			return nil, err
+		}
+		return engine.CSRIdentifiers(csr), nil
+	}
+	domains, err := engine.ParseDomainList(aconfig.Domains)
+	if err != nil {
+		return nil, err
+	}
+	return domains.Identifiers(), nil
+}
+
+// planShards 根据 MaxNamesPerCert 拆分 Domains, 尽量保持 previous 中已有的分组
+func (aconfig *AcmeConfig) planShards(previous []engine.Shard) {
+	domains, err := engine.ParseDomainList(aconfig.Domains)
+	if aconfig.MaxNamesPerCert <= 0 || err != nil {
+		aconfig.Shards = nil
+		return
+	}
+	aconfig.Shards = engine.PlanShards(domains, aconfig.MaxNamesPerCert, previous, aconfig.CertPath, aconfig.KeyPath)
+}
+
+// shard 返回单个分片的配置, 与原配置共用账户
+func (aconfig *AcmeConfig) shard(shard engine.Shard) *AcmeConfig {
+	conf := *aconfig
+	conf.Domains = strings.Join(shard.Domains, ",")
+	conf.CertPath = shard.CertPath
+	conf.KeyPath = shard.KeyPath
+	conf.MaxNamesPerCert = 0
+	conf.Shards = nil
+	return &conf
+}
+
+func (aconfig *AcmeConfig) orderOptions() (engine.OrderOptions, error) {
+	now := time.Now()
+	notBefore, err := engine.ParseOrderTime(aconfig.NotBefore, now)
+	if err != nil {
+		return engine.OrderOptions{}, fmt.Errorf("notBefore is not valid: %v", err)
+	}
+	notAfter, err := engine.ParseOrderTime(aconfig.NotAfter, now)
+	if err != nil {
+		return engine.OrderOptions{}, fmt.Errorf("notAfter is not valid: %v", err)
+	}
+	httpClient, err := aconfig.httpClient()
+	if err != nil {
+		return engine.OrderOptions{}, err
+	}
+	return engine.OrderOptions{Profile: aconfig.Profile, NotBefore: notBefore, NotAfter: notAfter, HTTPClient: httpClient}, nil
+}
+
+// httpClient 返回配置的 http client, 未设置的选项使用全局的默认值
+func (aconfig *AcmeConfig) httpClient() (*http.Client, error) {
+	return httpclient.For(aconfig.Http)
+}
+
+// lockedAccount 同 account, 用于未持有 configsMu 的调用方
+func (aconfig *AcmeConfig) lockedAccount(directoryUrl string) *Account {
+	configsMu.RLock()
+	defer configsMu.RUnlock()
+	return aconfig.account(directoryUrl)
+}
+
+// account 返回 CA 的账户, 调用方须持有 configsMu
+func (aconfig *AcmeConfig) account(directoryUrl string) *Account {
+	return aconfig.Accounts[directoryUrl]
+}
+
+func (aconfig *AcmeConfig) setAccount(directoryUrl string, account *Account) {
+	configsMu.Lock()
+	defer configsMu.Unlock()
+	if aconfig.Accounts == nil {
+		aconfig.Accounts = make(map[string]*Account)
+	}
+	aconfig.Accounts[directoryUrl] = account
+}
+
+// migrateAccount 把旧版本的 Account 移到 Accounts, 它属于当时的 directoryUrl, 即现在的第一个 directory url
+func (aconfig *AcmeConfig) migrateAccount() {
+	if aconfig.Account == nil {
+		return
+	}
+	directoryUrl := aconfig.directoryUrls()[0]
+	if aconfig.Accounts[directoryUrl] == nil {
+		if aconfig.Accounts == nil {
+			aconfig.Accounts = make(map[string]*Account)
+		}
+		aconfig.Accounts[directoryUrl] = aconfig.Account
+	}
+	aconfig.Account = nil
 }
 
 type Account struct {
@@ -60,17 +256,31 @@ func handleConfig(w http.ResponseWriter, r *http.Request) {
 
 func getConfigs(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	bytes, _ := json.Marshal(AcmeConfigs)
+	configsMu.Lock()
+	defer configsMu.Unlock()
+	// API token 只能看到允许的配置
+	confs := make(map[string]*AcmeConfig)
+	for id, conf := range AcmeConfigs {
+		if !requestAllows(r, id) {
+			continue
+		}
+		conf.refreshStatus()
+		confs[id] = conf
+	}
+	bytes, _ := json.Marshal(confs)
 	w.Write(bytes)
 }
 
 func getConfig(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
+	configsMu.Lock()
+	defer configsMu.Unlock()
 	conf := AcmeConfigs[id]
 	if conf == nil {
 		w.Write([]byte("{\"err\": 4000,\"msg\": \"No id matched!!!\"}"))
 		return
 	}
+	conf.refreshStatus()
 	bytes, _ := json.Marshal(conf)
 	w.Write(bytes)
 }
@@ -101,6 +311,27 @@ func _setConfig(w http.ResponseWriter, r *http.Request) (int, interface{}) {
 	// 	return 4003, fmt.Sprintf("%+v", err)
 	// } else {
 	// }
+	if !requestAllows(r, aconfig.Id) {
+		return 4013, "The token is not allowed to access this config"
+	}
+	if fieldErrs := aconfig.validate(); len(fieldErrs) > 0 {
+		return 4003, fieldErrs
+	}
+	aconfig.migrateAccount()
+	configsMu.Lock()
+	previous := aconfig.Shards
+	if old := AcmeConfigs[aconfig.Id]; len(previous) == 0 && old != nil {
+		previous = old.Shards
+	}
+	if old := AcmeConfigs[aconfig.Id]; old != nil {
+		aconfig.reissuePending = old.reissuePending
+	}
+	aconfig.planShards(previous)
+	aconfig.Status = nil
 	AcmeConfigs[string(aconfig.Id)] = &aconfig
+	configsMu.Unlock()
+	saveConfigs()
+	// 保存后检查已有证书是否覆盖新的 Domains
+	go checkDomains(&aconfig)
 	return 2000, "ok"
 }
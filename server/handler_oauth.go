@@ -1,15 +1,89 @@
 package server
 
 import (
-	"bytes"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
-	"io"
+	"log"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/nicennnnnnnlee/cert_bot/idp"
 )
 
+// oauthProvider 是登录使用的身份提供方, 由 OAuthProvider 选择
+var oauthProvider idp.Provider
+
+func newOAuthProvider() idp.Provider {
+	var scopes []string
+	if oauthScopes != "" {
+		scopes = strings.Fields(strings.ReplaceAll(oauthScopes, ",", " "))
+	}
+	provider, err := idp.New(idp.Config{
+		Provider:     oauthProviderName,
+		Issuer:       oauthIssuer,
+		ClientId:     oauthClientId,
+		ClientSecret: oauthClientSecret,
+		Scopes:       scopes,
+		UserClaim:    oauthUserClaim,
+		GroupsClaim:  oauthGroupsClaim,
+		Groups:       oauthValidGroups != "",
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return provider
+}
+
+// oauthRedirectUrl 返回回调地址, github 未设置 OAuthRedirectUrl 时使用注册的回调地址
+func oauthRedirectUrl(r *http.Request) string {
+	if oauthRedirectUri != "" {
+		return oauthRedirectUri
+	}
+	if oauthProviderName == "github" {
+		return ""
+	}
+	return "https://" + r.Host + uOAuth
+}
+
+// oauthState 是登录时签名保存在 cookie 中的 state, nonce 和 code verifier
+type oauthState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Expires  int64  `json:"exp"`
+}
+
+// oauthLogin 跳转到身份提供方登录, state, nonce 和 PKCE 的 code verifier 保存在只用于回调的 cookie 中
+func oauthLogin(w http.ResponseWriter, r *http.Request) {
+	state, nonce, verifier := idp.NewCodeVerifier(), idp.NewCodeVerifier(), idp.NewCodeVerifier()
+	authUrl, err := oauthProvider.AuthCodeURL(state, nonce, verifier, oauthRedirectUrl(r))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "The identity provider is not available", http.StatusBadGateway)
+		return
+	}
+	hostWithoutPort, _ := splitHostPort(r.Host)
+	signed := signValue("oauth", &oauthState{State: state, Nonce: nonce, Verifier: verifier, Expires: time.Now().Add(10 * time.Minute).Unix()})
+	cstate := fmt.Sprintf(oauthCookieFormat, oauthCookieNamePrefix+"_oauth", signed, hostWithoutPort, uOAuth, "600")
+	w.Header().Add("Set-Cookie", cstate)
+	http.Redirect(w, r, authUrl, http.StatusFound)
+}
+
+// oauthAllowed 判断用户是否在 OAuthValidUsers 中, 或属于 OAuthValidGroups 中的组
+func oauthAllowed(id *idp.Identity) bool {
+	if _, ok := oauthValidHashes[HashMd5(strings.ToLower(id.User))]; ok {
+		return true
+	}
+	for _, group := range id.Groups {
+		if _, ok := oauthValidGroupSet[strings.ToLower(group)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 func oauth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	errCode, data := _oauth(w, r)
@@ -23,98 +97,34 @@ func _oauth(w http.ResponseWriter, r *http.Request) (int, interface{}) {
 	if code == "" {
 		return 4005, "no code"
 	}
-	token, err := getToken(code)
+	hostWithoutPort, _ := splitHostPort(r.Host)
+	// state 须与登录时的 cookie 一致, 用过即删除
+	cstate, err := r.Cookie(oauthCookieNamePrefix + "_oauth")
+	w.Header().Add("Set-Cookie", fmt.Sprintf(oauthCookieFormat, oauthCookieNamePrefix+"_oauth", "", hostWithoutPort, uOAuth, "0"))
 	if err != nil {
-		return 4006, err.Error()
+		return 4007, "no login in progress"
 	}
-	id, err := getId(token)
+	var st oauthState
+	if !verifyValue("oauth", cstate.Value, &st) || time.Now().Unix() > st.Expires {
+		return 4007, "login expired, please retry"
+	}
+	if subtle.ConstantTimeCompare([]byte(st.State), []byte(r.URL.Query().Get("state"))) != 1 {
+		return 4007, "state does not match"
+	}
+	identity, err := oauthProvider.Exchange(code, st.Verifier, st.Nonce, oauthRedirectUrl(r))
 	if err != nil {
-		return 4007, err.Error()
+		return 4006, err.Error()
 	}
-	hashId := HashMd5(strings.ToLower(id))
-	_, ok := oauthValidHashes[hashId]
-	if !ok {
+	id := identity.User
+	if !oauthAllowed(identity) {
 		return 4008, id + " is not a valid user"
 	}
 
-	hostWithoutPort, _ := splitHostPort(r.Host)
+	_, signed := newSession(r, identity)
+	log.Println("login:", id)
 	w.Header().Set("Location", uStatic)
-	// github id
-	cid := fmt.Sprintf(oauthCookieFormat, oauthCookieNamePrefix+"_id", hashId, hostWithoutPort, oauthCookiePath, oauthCookieTTL)
-	w.Header().Add("Set-Cookie", cid)
-	// time
-	now := time.Now().Unix()
-	nowStr := fmt.Sprintf("%d", now)
-	ctime := fmt.Sprintf(oauthCookieFormat, oauthCookieNamePrefix+"_t", nowStr, hostWithoutPort, oauthCookiePath, oauthCookieTTL)
-	w.Header().Add("Set-Cookie", ctime)
-	// verify
-	raw := fmt.Sprintf("%s|%s|%s", hashId, oauthSalt, nowStr)
-	hash := HashSHA1(raw)
-	cvp := fmt.Sprintf(oauthCookieFormat, oauthCookieNamePrefix+"_vp", hash, hostWithoutPort, oauthCookiePath, oauthCookieTTL)
-	w.Header().Add("Set-Cookie", cvp)
+	cs := fmt.Sprintf(oauthCookieFormat, oauthCookieNamePrefix+"_s", signed, hostWithoutPort, oauthCookiePath, oauthCookieTTL)
+	w.Header().Add("Set-Cookie", cs)
 	w.WriteHeader(http.StatusFound)
 	return 2000, id
 }
-
-func getToken(code string) (string, error) {
-	var data = fmt.Sprintf(`{
-		"client_id": "%s",
-		"client_secret": "%s",
-		"code": "%s"
-	}`, oauthClientId, oauthClientSecret, code)
-	// log.Println("getToken: ", data)
-	req, _ := http.NewRequest("POST", "https://github.com/login/oauth/access_token", bytes.NewBufferString(data))
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/json;charset=UTF-8")
-	rsp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer rsp.Body.Close()
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return "", err
-	}
-	// log.Println(string(body))
-	result := make(map[string]json.RawMessage)
-	err = json.Unmarshal(body, &result)
-	if err != nil {
-		return "", err
-	}
-	token, ok := result["access_token"]
-	if ok {
-		return strings.Trim(string(token), `"`), nil
-	} else {
-		return "", fmt.Errorf("no 'access_token' in response: %s", string(body))
-	}
-}
-
-func getId(token string) (string, error) {
-	req, _ := http.NewRequest("GET", "https://api.github.com/user", nil)
-	req.Header.Add("Accept", "application/vnd.github+json")
-	req.Header.Add("Authorization", "Bearer "+token)
-	req.Header.Add("X-GitHub-Api-Version", "2022-11-28")
-	rsp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer rsp.Body.Close()
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return "", err
-	}
-	// fmt.Println(string(body))
-	result := make(map[string]json.RawMessage)
-	err = json.Unmarshal(body, &result)
-	if err != nil {
-		return "", err
-	}
-	id, ok := result["login"]
-	if ok {
-		return strings.Trim(string(id), `"`), nil
-	} else {
-		return "", fmt.Errorf("no 'login' in response: %s", string(body))
-	}
-}
@@ -0,0 +1,378 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/eggsampler/acme/v3"
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+	"github.com/nicennnnnnnlee/cert_bot/httpclient"
+)
+
+// doCertReq 把申请加入任务队列, 与后台任务一样逐个执行, 并输出任务的日志直到结束
+func doCertReq(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if !requestAllows(r, id) {
+		writeAuthError(w, http.StatusForbidden, 4013, "The token is not allowed to access this config")
+		return
+	}
+	conf := getAcmeConfig(id)
+	if conf == nil {
+		w.Write([]byte("{\"err\": 4000,\"msg\": \"No id matched!!!\"}"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	job := enqueueJob(id, "requested by api")
+	Fprintf := newFprintf(w)
+	Fprintf("Job %s: %s", job.Id, job.Status)
+	status, err := followJob(r.Context(), job, w)
+	if err != nil {
+		// 客户端断开时任务继续执行
+		return
+	}
+	if status == JobFailed {
+		problem, _ := json.Marshal(job.problem())
+		fmt.Fprintf(w, "Problem: %s", problem)
+	}
+}
+
+// issueCert 为配置申请证书, 拆分过的配置逐个分片申请, shards 不为空时只申请其中的分片
+func issueCert(conf *AcmeConfig, shards []int, w io.Writer) error {
+	configsMu.RLock()
+	confShards := conf.Shards
+	configsMu.RUnlock()
+	if len(confShards) == 0 {
+		return doCertReqWithFailover(conf, w)
+	}
+	for _, shard := range confShards {
+		if len(shards) > 0 && !slices.Contains(shards, shard.Index) {
+			continue
+		}
+		fmt.Fprintf(w, "Shard %d: %s\n", shard.Index, strings.Join(shard.Domains, ","))
+		configsMu.RLock()
+		shardConf := conf.shard(shard)
+		configsMu.RUnlock()
+		err := doCertReqWithFailover(shardConf, w)
+		// the shards share the accounts of the config
+		configsMu.Lock()
+		conf.Accounts = shardConf.Accounts
+		configsMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newFprintf 返回逐行输出的 Fprintf, w 支持时每行都 flush
+func newFprintf(w io.Writer) func(format string, a ...any) {
+	flusher, _ := w.(http.Flusher)
+	return func(format string, a ...any) {
+		fmt.Fprintf(w, format, a...)
+		fmt.Fprintln(w)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// doCertReqWithFailover 按顺序尝试每个CA, 直到成功或遇到不需要切换CA的错误
+func doCertReqWithFailover(conf *AcmeConfig, w io.Writer) error {
+	var err error
+	dirUrls := conf.directoryUrls()
+	for i, dirUrl := range dirUrls {
+		err = _doCertReq(conf, dirUrl, w)
+		if err == nil || i == len(dirUrls)-1 || !engine.IsFailoverError(err) {
+			break
+		}
+		fmt.Fprintf(w, "%+v\n", err)
+		fmt.Fprintf(w, "Retrying with next CA: %s\n", dirUrls[i+1])
+	}
+	return err
+}
+
+// challengeType 选择 identifier 的验证方式: ip 只能用 http-01/tls-alpn-01, 域名在配置了 dns01 时用 dns-01
+func (aconfig *AcmeConfig) challengeType(id acme.Identifier) string {
+	if id.Type == "ip" {
+		if enableTlsAlpn01 == "true" && enableHttp01 != "true" {
+			return acme.ChallengeTypeTLSALPN01
+		}
+		return acme.ChallengeTypeHTTP01
+	}
+	if aconfig.challenge != "" {
+		return aconfig.challenge
+	}
+	if aconfig.Dns01 != nil {
+		return acme.ChallengeTypeDNS01
+	}
+	return acme.ChallengeTypeHTTP01
+}
+
+func _doCertReq(aconfig *AcmeConfig, directoryUrl string, w io.Writer) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("error doCertReq: %v", r)
+		}
+	}()
+	var Fprintf = newFprintf(w)
+
+	// make sure a CertPath/ directory exists
+	var parentDir string
+	parentDir = filepath.Dir(aconfig.CertPath)
+	if _, err := os.Stat(parentDir); os.IsNotExist(err) {
+		log.Printf("Making directory path: %s", parentDir)
+		if err := os.MkdirAll(parentDir, 0755); err != nil {
+			return fmt.Errorf("error creating certPath parentdir %q: %v", parentDir, err)
+		}
+	}
+	if aconfig.Csr == "" {
+		parentDir = filepath.Dir(aconfig.KeyPath)
+		if _, err := os.Stat(parentDir); os.IsNotExist(err) {
+			log.Printf("Making directory path: %s", parentDir)
+			if err := os.MkdirAll(parentDir, 0755); err != nil {
+				return fmt.Errorf("error creating keyPath parentdir %q: %v", parentDir, err)
+			}
+		}
+	}
+
+	// the identifiers of an uploaded csr come from its SANs, Domains is ignored
+	var userCsr *x509.CertificateRequest
+	if aconfig.Csr != "" {
+		userCsr, err = engine.ParseCSR([]byte(aconfig.Csr))
+		if err != nil {
+			return err
+		}
+	}
+	ids, err := aconfig.identifiers()
+	if err != nil {
+		return err
+	}
+	domainList := engine.IdentifierValues(ids)
+
+	// 下单前加载信任的根证书, 无法验证的证书链不必申请
+	roots, err := engine.RootsFor(directoryUrl, aconfig.TrustedRootsFile)
+	if err != nil {
+		return err
+	}
+
+	Fprintf("Connecting to acme directory url: %s", directoryUrl)
+	httpClient, err := aconfig.httpClient()
+	if err != nil {
+		return err
+	}
+	// 记录 CA 返回的 Retry-After, acme 库的错误中没有响应头
+	httpClient, retryAfter := engine.RecordRetryAfter(httpClient)
+	clientOptions := []acme.OptionFunc{acme.WithHTTPClient(httpClient)}
+	if ua := aconfig.Http.Merge(httpclient.DefaultOptions()).UserAgent; ua != "" {
+		// the acme client sends its own user agent, ours is appended
+		clientOptions = append(clientOptions, acme.WithUserAgentSuffix(ua))
+	}
+	client, err := acme.NewClient(directoryUrl, clientOptions...)
+	if err != nil {
+		return engine.Failover(fmt.Errorf("error connecting to acme directory: %v", err))
+	}
+
+	account, err := loadAccount(client, aconfig, directoryUrl, Fprintf)
+	if err != nil {
+		return err
+	}
+
+	// 上次未完成的订单仍是 pending/ready 时继续使用, 不再创建新订单
+	statePath := engine.OrderStatePath(aconfig.CertPath)
+	state, err := engine.LoadOrderState(statePath)
+	if err != nil {
+		Fprintf("Ignoring order state: %v", err)
+	}
+	var order acme.Order
+	if state.Matches(directoryUrl, account.URL, ids) {
+		Fprintf("Resuming order: %s", state.OrderUrl)
+		order, err = engine.ResumeOrder(client, account, state)
+		if err != nil {
+			Fprintf("Can not resume order: %v", err)
+			state = nil
+		}
+	} else {
+		state = nil
+	}
+
+	if state == nil {
+		if err := checkBudget(directoryUrl, account.URL, domainList, Fprintf); err != nil {
+			return err
+		}
+		if !aconfig.SkipChecks {
+			Fprintf("Checking CAA and DNS records")
+			report, err := aconfig.preflight(directoryUrl, account.URL, ids)
+			if err != nil {
+				return err
+			}
+			for _, line := range report.Lines() {
+				Fprintf("%s", line)
+			}
+			if err := report.Err(); err != nil {
+				return err
+			}
+		}
+
+		orderOptions, err := aconfig.orderOptions()
+		if err != nil {
+			return err
+		}
+		Fprintf("Creating new order for domains: %s", domainList)
+		err = engine.Retry("creating new order", engine.DefaultRetryPolicy, Fprintf, func() (err error) {
+			order, err = engine.NewOrder(client, account, directoryUrl, ids, orderOptions)
+			return retryAfter.Attach(err)
+		})
+		if err != nil {
+			return err
+		}
+		Fprintf("Order created: %s", order.URL)
+		recordEvent(engine.EventOrder, directoryUrl, account.URL, domainList, Fprintf)
+		state = engine.NewOrderState(directoryUrl, account.URL, order, ids)
+		saveOrderState(state, statePath, Fprintf)
+	}
+	// loop through each of the provided authorization urls
+	dMap := make(map[string]interface{})
+	for _, authUrl := range order.Authorizations {
+		// fetch the authorization data from the acme service given the provided authorization url
+		Fprintf("Fetching authorization: %s", authUrl)
+		auth, err := client.FetchAuthorization(account, authUrl)
+		if err != nil {
+			return fmt.Errorf("error fetching authorization url %q: %w", authUrl, err)
+		}
+		Fprintf("Fetched authorization: %s", auth.Identifier.Value)
+		if auth.Status == "valid" {
+			// 恢复的订单中已经通过验证
+			Fprintf("Authorization %s is already valid", auth.Identifier.Value)
+			state.SetAuthorization(authUrl, auth.Status)
+			saveOrderState(state, statePath, Fprintf)
+			continue
+		}
+		chalType := aconfig.challengeType(auth.Identifier)
+		chal, ok := auth.ChallengeMap[chalType]
+		if !ok {
+			return fmt.Errorf("unable to find %s challenge for auth %s", chalType, auth.Identifier.Value)
+		}
+
+		switch chalType {
+		case acme.ChallengeTypeDNS01:
+			err = solveDns01(aconfig, auth, chal, dMap, Fprintf)
+		case acme.ChallengeTypeHTTP01:
+			var cleanup func()
+			cleanup, err = solveHttp01(auth, chal, Fprintf)
+			if cleanup != nil {
+				defer cleanup()
+			}
+		case acme.ChallengeTypeTLSALPN01:
+			var cleanup func()
+			cleanup, err = solveTlsAlpn01(auth, chal, Fprintf)
+			if cleanup != nil {
+				defer cleanup()
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		// update the acme server that the challenge file is ready to be queried
+		Fprintf("Updating challenge for authorization %s: %s", auth.Identifier.Value, chal.URL)
+		err = engine.Retry("updating authorization "+auth.Identifier.Value+" challenge", engine.DefaultRetryPolicy, Fprintf, func() (err error) {
+			updated, err := client.UpdateChallenge(account, chal)
+			if err == nil {
+				chal = updated
+			}
+			return retryAfter.Attach(err)
+		})
+		if err != nil {
+			if _, ok := engine.AsProblem(err); ok {
+				recordEvent(engine.EventFailedValidation, directoryUrl, account.URL, []string{auth.Identifier.Value}, Fprintf)
+			}
+			return err
+		}
+		Fprintf("Challenge updated")
+		state.SetAuthorization(authUrl, chal.Status)
+		saveOrderState(state, statePath, Fprintf)
+	}
+	// all the challenges should now be completed
+
+	csr := userCsr
+	var certKey *ecdsa.PrivateKey
+	if csr != nil {
+		Fprintf("Using the uploaded csr, no private key is written, csrOptions are ignored")
+	} else {
+		// 私钥随订单保存, 恢复的订单沿用同一个私钥
+		certKey, err = state.PlannedKey()
+		if err != nil {
+			return err
+		}
+		saveOrderState(state, statePath, Fprintf)
+		Fprintf("Creating csr")
+		csr, err = engine.CreateCSR(certKey, ids, aconfig.CsrOptions)
+		if err != nil {
+			return err
+		}
+	}
+
+	// finalize the order with the acme server given a csr
+	Fprintf("Finalising order: %s", order.URL)
+	err = engine.Retry("finalizing order", engine.DefaultRetryPolicy, Fprintf, func() (err error) {
+		finalized, err := client.FinalizeOrder(account, order, csr)
+		if err == nil {
+			order = finalized
+		}
+		return retryAfter.Attach(err)
+	})
+	if err != nil {
+		return err
+	}
+
+	// fetch the certificate chain from the finalized order provided by the acme server
+	Fprintf("Fetching certificate: %s", order.Certificate)
+	certs, err := engine.FetchCertificates(client, account, order.Certificate, aconfig.PreferredChain)
+	if err != nil {
+		return fmt.Errorf("error fetching order certificates: %w", err)
+	}
+	Fprintf("Certificate chain issued by: %s", engine.ChainIssuer(certs))
+	recordEvent(engine.EventCertificate, directoryUrl, account.URL, domainList, Fprintf)
+
+	// 写入前检查证书链, 不部署有问题的证书
+	Fprintf("Verifying certificate chain")
+	if err := engine.VerifyChain(certs, engine.VerifyOptions{PublicKey: csr.PublicKey, Identifiers: ids, Roots: roots}); err != nil {
+		return err
+	}
+
+	// write the pem encoded certificate chain and key, both or neither
+	Fprintf("Saving certificate to: %s", aconfig.CertPath)
+	var keyPem []byte
+	if certKey != nil {
+		Fprintf("Writing key file: %s", aconfig.KeyPath)
+		keyPem = key2pem(certKey)
+	}
+	if err := engine.WriteCertificate(aconfig.CertPath, certs, aconfig.KeyPath, keyPem); err != nil {
+		return err
+	}
+	Fprintf("Certificate expires at %s, renew after %s", certs[0].NotAfter, engine.RenewalTime(certs[0]))
+	// the https server may serve this certificate
+	reloadTlsCert()
+	if err := engine.RemoveOrderState(statePath); err != nil {
+		Fprintf("%v", err)
+	}
+
+	Fprintf("Done.")
+	return nil
+}
+
+// saveOrderState 保存订单进度, 失败时只记录, 不影响本次申请
+func saveOrderState(state *engine.OrderState, statePath string, Fprintf func(format string, a ...any)) {
+	if err := state.Save(statePath); err != nil {
+		Fprintf("%v", err)
+	}
+}
@@ -0,0 +1,19 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/eggsampler/acme/v3"
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+var tlsAlpn01Responder = &engine.TLSALPN01Responder{}
+
+func solveTlsAlpn01(auth acme.Authorization, chal acme.Challenge, Fprintf func(format string, a ...any)) (func(), error) {
+	Fprintf("TlsAlpn01 challenge")
+	if err := tlsAlpn01Responder.Add(auth.Identifier, chal.KeyAuthorization); err != nil {
+		return nil, fmt.Errorf("error creating authorization %s challenge certificate: %v", auth.Identifier.Value, err)
+	}
+	Fprintf("Challenge certificate ready for: %s", auth.Identifier.Value)
+	return func() { tlsAlpn01Responder.Remove(auth.Identifier) }, nil
+}
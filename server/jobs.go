@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// 保留的任务记录数
+const maxJobs = 100
+
+// Job 是后台的证书申请任务, 如 Domains 变更后的重新签发
+type Job struct {
+	Id       string `json:"id"`
+	ConfigId string `json:"configId"`
+	Reason   string `json:"reason"`
+	Status   string `json:"status"`
+	// 只签发这些分片, 为空时签发所有分片
+	Shards []int  `json:"shards,omitempty"`
+	Err    string `json:"err,omitempty"`
+	// 失败时的 ACME problem 类型及 subproblems
+	Problem  *engine.ProblemInfo `json:"problem,omitempty"`
+	Created  time.Time           `json:"created"`
+	Started  time.Time           `json:"started,omitempty"`
+	Finished time.Time           `json:"finished,omitempty"`
+
+	mu  sync.Mutex
+	log bytes.Buffer
+}
+
+// Write 记录任务日志, 实现 io.Writer
+func (job *Job) Write(p []byte) (int, error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.log.Write(p)
+}
+
+func (job *Job) Log() string {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.log.String()
+}
+
+var (
+	jobs       []*Job
+	jobsMu     sync.Mutex
+	jobSeq     int
+	jobQueue   = make(chan *Job, maxJobs)
+	jobsRunner sync.Once
+)
+
+// enqueueJob 为配置的所有证书添加申请任务, 已有排队或运行中的任务时直接返回该任务
+func enqueueJob(configId string, reason string) *Job {
+	return enqueueShardsJob(configId, reason, nil)
+}
+
+// enqueueShardsJob 为配置的部分分片添加申请任务, shards 为空时申请所有证书.
+// 已有排队的任务时把分片合并到该任务中, 已有运行中的任务时直接返回该任务
+func enqueueShardsJob(configId string, reason string, shards []int) *Job {
+	jobsRunner.Do(func() { go runJobs() })
+	jobsMu.Lock()
+	for _, job := range jobs {
+		if job.ConfigId == configId && (job.Status == JobQueued || job.Status == JobRunning) {
+			if job.Status == JobQueued {
+				job.Shards = mergeShards(job.Shards, shards)
+			}
+			jobsMu.Unlock()
+			return job
+		}
+	}
+	jobSeq++
+	job := &Job{
+		Id:       fmt.Sprintf("%d", jobSeq),
+		ConfigId: configId,
+		Reason:   reason,
+		Status:   JobQueued,
+		Shards:   shards,
+		Created:  time.Now(),
+	}
+	jobs = append(jobs, job)
+	trimJobs()
+	jobsMu.Unlock()
+	// runJobs 更新状态时需要 jobsMu, 不能持锁发送
+	jobQueue <- job
+	return job
+}
+
+// mergeShards 合并两个任务的分片, 其中一个为空(所有分片)时结果也为空
+func mergeShards(a []int, b []int) []int {
+	if len(a) == 0 || len(b) == 0 {
+		return nil
+	}
+	merged := append([]int(nil), a...)
+	for _, index := range b {
+		if !slices.Contains(merged, index) {
+			merged = append(merged, index)
+		}
+	}
+	sort.Ints(merged)
+	return merged
+}
+
+// trimJobs 只保留最近的 maxJobs 个已结束的任务, 排队和运行中的任务不删除, 调用方须持有 jobsMu
+func trimJobs() {
+	finished := 0
+	for _, job := range jobs {
+		if job.Status == JobDone || job.Status == JobFailed {
+			finished++
+		}
+	}
+	kept := jobs[:0]
+	for _, job := range jobs {
+		if finished > maxJobs && (job.Status == JobDone || job.Status == JobFailed) {
+			finished--
+			continue
+		}
+		kept = append(kept, job)
+	}
+	jobs = kept
+}
+
+// followJob 把任务的日志输出到 w, 直到任务结束或 ctx 取消
+func followJob(ctx context.Context, job *Job, w io.Writer) (string, error) {
+	flusher, _ := w.(http.Flusher)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	written := 0
+	for {
+		jobsMu.Lock()
+		status := job.Status
+		jobsMu.Unlock()
+		if log := job.Log(); len(log) > written {
+			w.Write([]byte(log[written:]))
+			written = len(log)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if status == JobDone || status == JobFailed {
+			return status, nil
+		}
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (job *Job) problem() *engine.ProblemInfo {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return job.Problem
+}
+
+func getJob(id string) *Job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, job := range jobs {
+		if job.Id == id {
+			return job
+		}
+	}
+	return nil
+}
+
+func setJobStatus(job *Job, status string, err error) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	job.Status = status
+	switch status {
+	case JobRunning:
+		job.Started = time.Now()
+	case JobDone, JobFailed:
+		job.Finished = time.Now()
+	}
+	if err != nil {
+		job.Err = err.Error()
+		job.Problem = engine.Problem(err)
+	}
+}
+
+// runJobs 逐个执行任务, 避免同时向CA发起多个申请
+func runJobs() {
+	for job := range jobQueue {
+		setJobStatus(job, JobRunning, nil)
+		jobsMu.Lock()
+		shards := job.Shards
+		jobsMu.Unlock()
+		conf := getAcmeConfig(job.ConfigId)
+		var err error
+		if conf == nil {
+			err = fmt.Errorf("config %s not found", job.ConfigId)
+		} else {
+			fmt.Fprintf(job, "Job %s: %s\n", job.Id, job.Reason)
+			err = issueCert(conf, shards, job)
+			saveConfigs()
+		}
+		if err != nil {
+			fmt.Fprintf(job, "%+v\n", err)
+			setJobStatus(job, JobFailed, err)
+		} else {
+			setJobStatus(job, JobDone, nil)
+		}
+	}
+}
+
+func getJobs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	jobsMu.Lock()
+	// API token 只能看到允许的配置的任务
+	list := make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		if requestAllows(r, job.ConfigId) {
+			list = append(list, job)
+		}
+	}
+	bytes, _ := json.Marshal(list)
+	jobsMu.Unlock()
+	w.Write(bytes)
+}
+
+// getJobLog 返回任务的日志
+func getJobLog(w http.ResponseWriter, r *http.Request) {
+	job := getJob(r.URL.Query().Get("id"))
+	if job == nil || !requestAllows(r, job.ConfigId) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{\"err\": 4000,\"msg\": \"No id matched!!!\"}"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(job.Log()))
+}
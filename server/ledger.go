@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+// ledger 记录订单, 验证失败和签发的证书, 用于估算CA的限额
+var ledger = openLedger()
+
+func openLedger() *engine.Ledger {
+	l, err := engine.OpenLedger(ledgerFile)
+	if err != nil {
+		log.Printf("%v, using an empty ledger\n", err)
+		l, _ = engine.OpenLedger("")
+	}
+	return l
+}
+
+// budget 返回账户在CA上为 names 剩余的限额, CA的限额未知时返回 nil
+func budget(directoryUrl string, accountUrl string, names []string) *engine.Budget {
+	limits, ok := engine.LimitsFor(directoryUrl)
+	if !ok {
+		return nil
+	}
+	return ledger.Budget(limits, directoryUrl, accountUrl, names, time.Now())
+}
+
+// configBudget 返回配置在首选CA上的剩余限额, 有多个分片时取最小值
+func (aconfig *AcmeConfig) configBudget() *engine.Budget {
+	directoryUrl := aconfig.directoryUrls()[0]
+	var accountUrl string
+	if account := aconfig.account(directoryUrl); account != nil {
+		accountUrl = account.Url
+	}
+	var least *engine.Budget
+	for _, target := range aconfig.certTargets() {
+		b := budget(directoryUrl, accountUrl, target.names)
+		if b == nil {
+			return nil
+		}
+		least = least.Min(b)
+	}
+	return least
+}
+
+// checkBudget 在下单前检查限额, RateLimitMode 为 refuse 时拒绝会超出限额的订单
+func checkBudget(directoryUrl string, accountUrl string, names []string, Fprintf func(format string, a ...any)) error {
+	if rateLimitMode == "off" {
+		return nil
+	}
+	b := budget(directoryUrl, accountUrl, names)
+	if b == nil {
+		return nil
+	}
+	if exhausted := b.Exhausted(); len(exhausted) > 0 {
+		if rateLimitMode == "refuse" {
+			// 其它CA的限额是独立的
+			return engine.Failover(fmt.Errorf("the order would exceed the rate limits: %s", strings.Join(exhausted, "; ")))
+		}
+		Fprintf("Warning: the order may exceed the rate limits: %s", strings.Join(exhausted, "; "))
+		return nil
+	}
+	if low := b.Low(); len(low) > 0 {
+		Fprintf("Warning: the rate limits are almost used up: %s", strings.Join(low, "; "))
+	}
+	return nil
+}
+
+func recordEvent(kind string, directoryUrl string, accountUrl string, names []string, Fprintf func(format string, a ...any)) {
+	if err := ledger.Record(kind, directoryUrl, accountUrl, names); err != nil {
+		Fprintf("%v", err)
+	}
+}
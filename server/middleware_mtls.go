@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var clientCertValidUsers map[string]interface{}
+
+func isNeedClientCert() bool {
+	needCert := clientCaFile != ""
+	if needCert {
+		if clientCertUsers == "" {
+			log.Fatalln(`'ClientCertUsers' should be set in env. 
+			For multi-users, seperate the common names or SANs of the client certificates by ','. 
+			For example, "deploy-bot,ci@example.com"`)
+		}
+		clientCertValidUsers = make(map[string]interface{})
+		for _, user := range splitList(clientCertUsers) {
+			log.Println("Client Cert Valid User: ", user)
+			clientCertValidUsers[strings.ToLower(user)] = nil
+		}
+	}
+	return needCert
+}
+
+// setClientAuth 设置客户端证书验证: optional 时没有证书的客户端可以使用 OAuth, require 时握手必须提供证书
+func setClientAuth(conf *tls.Config) error {
+	if !bNeedClientCert {
+		return nil
+	}
+	raw, err := os.ReadFile(clientCaFile)
+	if err != nil {
+		return fmt.Errorf("error reading client ca file %q: %v", clientCaFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return fmt.Errorf("no certificate found in client ca file %q", clientCaFile)
+	}
+	conf.ClientCAs = pool
+	switch clientAuth {
+	case "optional":
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("ClientAuth %q is not valid, use optional or require", clientAuth)
+	}
+	return nil
+}
+
+// clientCertUser 返回客户端证书对应的用户, 依次匹配 CN 和 SANs;
+// 没有经过 ClientCaFile 验证的证书或用户不在 ClientCertUsers 中时返回 ""
+func clientCertUser(r *http.Request) string {
+	if !bNeedClientCert || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	names := []string{leaf.Subject.CommonName}
+	names = append(names, leaf.DNSNames...)
+	names = append(names, leaf.EmailAddresses...)
+	for _, uri := range leaf.URIs {
+		names = append(names, uri.String())
+	}
+	for _, name := range names {
+		if _, ok := clientCertValidUsers[strings.ToLower(name)]; ok && name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+type clientCertKeyType struct{}
+
+func withClientCert(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientCertKeyType{}, user))
+}
+
+// sameOrigin 判断请求是否来自本站的页面, 或不是浏览器发出的.
+// 浏览器会自动带上安装的客户端证书, 跨站的请求不能借此修改数据
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none"
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	// 旧浏览器的跨站表单也会带 Origin, 没有时是 API 客户端
+	return true
+}
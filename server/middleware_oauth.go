@@ -1,30 +1,36 @@
 package server
 
 import (
-	"fmt"
 	"log"
 	"net/http"
-	"strconv"
 	"strings"
-	"time"
 )
 
 func isNeedOAuth() bool {
 	needAuth := oauthClientId != "" && oauthClientSecret != ""
 	if needAuth {
-		if oauthValidUsers == "" {
-			log.Fatalln(`'OAuthValidUsers' should be set in env. 
-			For multi-users, seperate github logins by ','. 
+		if oauthValidUsers == "" && oauthValidGroups == "" {
+			log.Fatalln(`'OAuthValidUsers' or 'OAuthValidGroups' should be set in env. 
+			For multi-users, seperate the logins by ','. 
 			For example, "user1,user2"`)
 		}
-		log.Println("OAuthSalt: ", oauthSalt)
+		oauthProvider = newOAuthProvider()
+		log.Println("OAuth Provider: ", oauthProviderName)
+		if err := initSessions(); err != nil {
+			log.Fatalln(err)
+		}
 		log.Println("OAuthCookieFormat: ", oauthCookieFormat)
 		oauthValidHashes = make(map[string]interface{})
-		for _, user := range strings.Split(oauthValidUsers, ",") {
+		for _, user := range splitList(oauthValidUsers) {
 			hash := HashMd5(strings.ToLower(user))
 			log.Println("OAuth Valid User: ", user, hash)
 			oauthValidHashes[hash] = nil
 		}
+		oauthValidGroupSet = make(map[string]interface{})
+		for _, group := range splitList(oauthValidGroups) {
+			log.Println("OAuth Valid Group: ", group)
+			oauthValidGroupSet[strings.ToLower(group)] = nil
+		}
 	}
 	return needAuth
 }
@@ -34,68 +40,49 @@ func AuthH(h http.Handler) http.HandlerFunc {
 }
 
 func AuthHF(h http.HandlerFunc) http.HandlerFunc {
-	if bNeedOAuth {
+	if bNeedOAuth || bNeedClientCert {
 		return func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Cache-Control", "private, max-age=0, no-cache")
 			w.Header().Add("Cache-Control", "private, max-age=0, must-revalidate")
 			w.Header().Add("Cache-Control", "no-store")
 			log.Println("check url:", r.RequestURI)
-			// 检查 cookie 的id time hash
-			if isValid(r) {
+			if isUnixSocket(r) {
+				h(w, r)
+				return
+			}
+			// 先检查客户端证书, 再检查会话 cookie
+			if user := clientCertUser(r); user != "" {
+				log.Println("client cert user:", user)
+				r = withClientCert(r, user)
+				if !isSafeMethod(r.Method) && !checkCsrf(r) {
+					writeCsrfError(w)
+					return
+				}
+				h(w, r)
+				return
+			}
+			var s *Session
+			if bNeedOAuth {
+				s = requestSession(r)
+			}
+			if s != nil {
+				r = withSession(r, s)
+				// 会话 cookie 会随跨站请求发送, 修改数据的请求须带 X-CSRF-Token
+				if !isSafeMethod(r.Method) && !checkCsrf(r) {
+					writeCsrfError(w)
+					return
+				}
 				h(w, r)
 				return
+			} else if bNeedOAuth {
+				oauthLogin(w, r)
 			} else {
-				http.Redirect(w, r, "https://github.com/login/oauth/authorize?client_id="+oauthClientId, http.StatusFound)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("{\"err\": 4010,\"msg\": \"A valid client certificate is required\"}"))
 			}
 		}
 	} else {
 		return h
 	}
 }
-
-func isValid(r *http.Request) bool {
-	hashId, isIdValid := checkValidId(r)
-	if isIdValid {
-		time, isTimeValid := checkValidTime(r)
-		if isTimeValid {
-			return isValidHash(r, hashId, time)
-		}
-	}
-	return false
-}
-func checkValidId(r *http.Request) (*string, bool) {
-	cid, err := r.Cookie(oauthCookieNamePrefix + "_id")
-	if err != nil {
-		return nil, false
-	}
-	_, ok := oauthValidHashes[cid.Value]
-	if !ok {
-		return nil, false
-	}
-	return &cid.Value, true
-}
-
-func checkValidTime(r *http.Request) (*int64, bool) {
-	cTime, err := r.Cookie(oauthCookieNamePrefix + "_t")
-	if err != nil {
-		return nil, false
-	}
-	cTimeInt64, _ := strconv.ParseInt(cTime.Value, 10, 64)
-	delta := time.Now().Unix() - cTimeInt64
-	if delta > oauthCookieTTLInt64 || delta < -oauthCookieTTLInt64 {
-		return nil, false
-	}
-	return &cTimeInt64, true
-}
-
-func isValidHash(r *http.Request, hashId *string, timeInt64 *int64) bool {
-	hash, err := r.Cookie(oauthCookieNamePrefix + "_vp")
-	if err != nil {
-		return false
-	}
-	expectedRaw := fmt.Sprintf("%s|%s|%d", *hashId, oauthSalt, *timeInt64)
-	expectedHash := HashSHA1(expectedRaw)
-	// log.Println("expectedHash:", expectedHash)
-	// log.Println("actualHash:", hash.Value)
-	return hash.Value == expectedHash
-}
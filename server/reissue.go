@@ -0,0 +1,225 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+// certTarget 是一张证书的路径, 私钥路径与其应包含的名称, shard 是分片的序号, 未拆分时为 0
+type certTarget struct {
+	shard   int
+	path    string
+	keyPath string
+	names   []string
+}
+
+// targetShards 返回 targets 的分片序号, 用于 enqueueShardsJob, 未拆分的配置返回 nil
+func targetShards(targets []certTarget) []int {
+	var shards []int
+	for _, target := range targets {
+		if target.shard > 0 {
+			shards = append(shards, target.shard)
+		}
+	}
+	return shards
+}
+
+// certTargets 返回配置的所有证书, 拆分后每个分片一个
+func (aconfig *AcmeConfig) certTargets() []certTarget {
+	if len(aconfig.Shards) > 0 {
+		var targets []certTarget
+		for _, shard := range aconfig.Shards {
+			targets = append(targets, certTarget{shard: shard.Index, path: shard.CertPath, keyPath: shard.KeyPath, names: shard.Domains})
+		}
+		return targets
+	}
+	var names []string
+	if aconfig.Csr != "" {
+		if csr, err := engine.ParseCSR([]byte(aconfig.Csr)); err == nil {
+			names = engine.IdentifierValues(engine.CSRIdentifiers(csr))
+		}
+	} else if domains, err := engine.ParseDomainList(aconfig.Domains); err == nil {
+		names = domains
+	}
+	return []certTarget{{path: aconfig.CertPath, keyPath: aconfig.KeyPath, names: names}}
+}
+
+// certNames 返回证书 SANs 中的域名和IP
+func certNames(cert *x509.Certificate) []string {
+	var names []string
+	for _, name := range cert.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// diffNames 返回 want 中证书没有的名称, 和证书中多出的名称
+func diffNames(want []string, have []string) (missing []string, extra []string) {
+	wanted := make(map[string]bool)
+	for _, name := range want {
+		wanted[strings.ToLower(name)] = true
+	}
+	had := make(map[string]bool)
+	for _, name := range have {
+		had[name] = true
+		if !wanted[name] {
+			extra = append(extra, name)
+		}
+	}
+	for name := range wanted {
+		if !had[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return
+}
+
+// domainsMismatch 比较配置的名称与证书的 SANs, 返回不一致的证书; 还没有证书(如新增的分片)时缺少所有名称
+func (aconfig *AcmeConfig) domainsMismatch() (missing []string, extra []string, stale []certTarget) {
+	for _, target := range aconfig.certTargets() {
+		if len(target.names) == 0 {
+			continue
+		}
+		var have []string
+		if cert, err := loadLeaf(target.path); err == nil {
+			have = certNames(cert)
+		}
+		m, e := diffNames(target.names, have)
+		if len(m) > 0 || len(e) > 0 {
+			stale = append(stale, target)
+		}
+		missing = append(missing, m...)
+		extra = append(extra, e...)
+	}
+	return
+}
+
+// checkDomains 检查证书是否覆盖配置的名称, 不一致时只为不一致的分片加入重新签发任务,
+// 设置了 ReissueNeedsApproval 的配置等待 /api/approve 确认
+func checkDomains(aconfig *AcmeConfig) {
+	configsMu.RLock()
+	missing, extra, stale := aconfig.domainsMismatch()
+	configsMu.RUnlock()
+	if len(missing) == 0 && len(extra) == 0 {
+		configsMu.Lock()
+		aconfig.reissuePending = false
+		configsMu.Unlock()
+		return
+	}
+	log.Printf("Config %s: certificate does not match domains, missing %v, extra %v\n", aconfig.Id, missing, extra)
+	if aconfig.ReissueNeedsApproval {
+		configsMu.Lock()
+		aconfig.reissuePending = true
+		configsMu.Unlock()
+		return
+	}
+	enqueueShardsJob(aconfig.Id, "certificate does not match domains", targetShards(stale))
+}
+
+// checkRenewal 为到达 engine.RenewalTime 的证书加入续期任务, 只续期到期的分片, 还没有证书文件的分片同样申请.
+// 返回之后最早的续期时间, 没有时为零值
+func checkRenewal(aconfig *AcmeConfig, now time.Time) time.Time {
+	configsMu.RLock()
+	targets := aconfig.certTargets()
+	configsMu.RUnlock()
+	var next time.Time
+	var due []certTarget
+	for _, target := range targets {
+		cert, err := loadLeaf(target.path)
+		if err != nil {
+			due = append(due, target)
+			continue
+		}
+		renewAt := engine.RenewalTime(cert)
+		if !now.Before(renewAt) {
+			log.Printf("Config %s: certificate %s is due for renewal since %s\n", aconfig.Id, target.path, renewAt)
+			due = append(due, target)
+			continue
+		}
+		if next.IsZero() || renewAt.Before(next) {
+			next = renewAt
+		}
+	}
+	if len(due) > 0 {
+		enqueueShardsJob(aconfig.Id, "certificate is due for renewal", targetShards(due))
+	}
+	return next
+}
+
+// checkDomainsLoop 每隔 interval 检查所有配置的名称
+func checkDomainsLoop(interval time.Duration) {
+	// 启动后先检查一次
+	time.Sleep(time.Minute)
+	for {
+		for _, conf := range listAcmeConfigs() {
+			checkDomains(conf)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// renewLoop 每隔 interval 检查所有配置的续期时间, 有证书更早到期时(如短期证书)提前检查
+func renewLoop(interval time.Duration) {
+	// 启动后先检查一次
+	wait := time.Minute
+	for {
+		time.Sleep(wait)
+		now := time.Now()
+		wait = interval
+		for _, conf := range listAcmeConfigs() {
+			if next := checkRenewal(conf, now); !next.IsZero() && next.Sub(now) < wait {
+				wait = next.Sub(now)
+			}
+		}
+		// 续期失败的证书等到下一个 interval 再试, 不会频繁请求CA
+		if wait < time.Minute {
+			wait = time.Minute
+		}
+	}
+}
+
+// approveReissue 确认等待中的重新签发
+func approveReissue(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if !requestAllows(r, id) {
+		writeAuthError(w, http.StatusForbidden, 4013, "The token is not allowed to access this config")
+		return
+	}
+	configsMu.Lock()
+	conf := AcmeConfigs[id]
+	pending := conf != nil && conf.reissuePending
+	var stale []certTarget
+	if pending {
+		conf.reissuePending = false
+		_, _, stale = conf.domainsMismatch()
+	}
+	configsMu.Unlock()
+	if conf == nil {
+		w.Write([]byte("{\"err\": 4000,\"msg\": \"No id matched!!!\"}"))
+		return
+	}
+	if !pending || len(stale) == 0 {
+		w.Write([]byte("{\"err\": 4004,\"msg\": \"No reissue pending\"}"))
+		return
+	}
+	job := enqueueShardsJob(id, "reissue approved", targetShards(stale))
+	bytes, _ := json.Marshal(&HttpResult{Err: 2000, Data: job.Id})
+	w.Write(bytes)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+func writeTestCert(t *testing.T, path string, hostname string) {
+	cert, err := selfSignedCert(hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// go test ./server -v -run TestDomainsMismatchShards
+func TestDomainsMismatchShards(t *testing.T) {
+	dir := t.TempDir()
+	conf := &AcmeConfig{Id: "shards", Domains: "a.example.com,b.example.com"}
+	conf.Shards = []engine.Shard{
+		{Index: 1, Domains: []string{"a.example.com"}, CertPath: filepath.Join(dir, "cert-1.pem")},
+		{Index: 2, Domains: []string{"b.example.com"}, CertPath: filepath.Join(dir, "cert-2.pem")},
+		{Index: 3, Domains: []string{"c.example.com"}, CertPath: filepath.Join(dir, "cert-3.pem")},
+	}
+	writeTestCert(t, conf.Shards[0].CertPath, "a.example.com")
+	writeTestCert(t, conf.Shards[1].CertPath, "old.example.com")
+
+	missing, extra, stale := conf.domainsMismatch()
+	if !reflect.DeepEqual(missing, []string{"b.example.com", "c.example.com"}) || !reflect.DeepEqual(extra, []string{"old.example.com"}) {
+		t.Fatalf("unexpected missing %v, extra %v", missing, extra)
+	}
+	// the shard without a certificate file yet is issued too, the matching one is not
+	if shards := targetShards(stale); !reflect.DeepEqual(shards, []int{2, 3}) {
+		t.Fatalf("expected shards 2 and 3 to be reissued, got %v", shards)
+	}
+}
+
+// go test ./server -v -run TestMergeShards
+func TestMergeShards(t *testing.T) {
+	if merged := mergeShards([]int{3, 1}, []int{2, 3}); !reflect.DeepEqual(merged, []int{1, 2, 3}) {
+		t.Errorf("unexpected merge %v", merged)
+	}
+	if merged := mergeShards([]int{1}, nil); merged != nil {
+		t.Errorf("a job of all shards should stay one of all shards, got %v", merged)
+	}
+}
+
+// go test ./server -v -run TestCheckRenewalShards
+func TestCheckRenewalShards(t *testing.T) {
+	dir := t.TempDir()
+	conf := &AcmeConfig{Id: "renewal-shards", Domains: "a.example.com,b.example.com"}
+	conf.Shards = []engine.Shard{
+		{Index: 1, Domains: []string{"a.example.com"}, CertPath: filepath.Join(dir, "cert-1.pem")},
+		{Index: 2, Domains: []string{"b.example.com"}, CertPath: filepath.Join(dir, "cert-2.pem")},
+	}
+	writeTestCert(t, conf.Shards[0].CertPath, "a.example.com")
+	cert, _ := loadLeaf(conf.Shards[0].CertPath)
+
+	now := time.Now()
+	if next := checkRenewal(conf, now); !next.Equal(engine.RenewalTime(cert)) {
+		t.Fatalf("the next renewal should be the one of shard 1, got %s", next)
+	}
+	var job *Job
+	jobsMu.Lock()
+	for _, j := range jobs {
+		if j.ConfigId == conf.Id {
+			job = j
+		}
+	}
+	jobsMu.Unlock()
+	if job == nil || !reflect.DeepEqual(job.Shards, []int{2}) {
+		t.Fatalf("only shard 2 should be renewed, got %+v", job)
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+// revocationRetry 是查询失败后再次查询的间隔
+const revocationRetry = 15 * time.Minute
+
+// revocations 缓存证书的吊销状态, TlsCert 装订 OCSP 响应和配置列表共用, key 为签发者与序列号
+var revocations = struct {
+	sync.Mutex
+	status  map[string]*engine.RevocationStatus
+	retryAt map[string]time.Time
+}{
+	status:  make(map[string]*engine.RevocationStatus),
+	retryAt: make(map[string]time.Time),
+}
+
+func revocationKey(leaf *x509.Certificate) string {
+	return hex.EncodeToString(leaf.AuthorityKeyId) + ":" + leaf.SerialNumber.Text(16)
+}
+
+// cachedRevocation 返回缓存的吊销状态, 不发起请求, 还没有查询过时返回 nil
+func cachedRevocation(leaf *x509.Certificate) *engine.RevocationStatus {
+	revocations.Lock()
+	defer revocations.Unlock()
+	return revocations.status[revocationKey(leaf)]
+}
+
+// checkRevocation 返回证书的吊销状态, 缓存到期时通过 OCSP 或 CRL 重新查询;
+// 查询失败时返回旧的状态(可能为 nil)和错误, revocationRetry 内不再查询
+func checkRevocation(leaf *x509.Certificate, issuer *x509.Certificate, httpClient *http.Client) (*engine.RevocationStatus, error) {
+	key := revocationKey(leaf)
+	now := time.Now()
+	revocations.Lock()
+	cached := revocations.status[key]
+	retryAt := revocations.retryAt[key]
+	revocations.Unlock()
+	if cached != nil && now.Before(cached.RefreshAt()) || now.Before(retryAt) {
+		return cached, nil
+	}
+
+	status, err := engine.CheckRevocation(httpClient, leaf, issuer)
+	revocations.Lock()
+	defer revocations.Unlock()
+	if err != nil {
+		revocations.retryAt[key] = now.Add(revocationRetry)
+		return cached, err
+	}
+	delete(revocations.retryAt, key)
+	revocations.status[key] = status
+	return status, nil
+}
+
+// checkConfigRevocation 检查配置的所有证书, 被吊销的证书加入重新签发任务
+func checkConfigRevocation(aconfig *AcmeConfig) {
+	httpClient, err := aconfig.httpClient()
+	if err != nil {
+		return
+	}
+	for _, target := range aconfig.certTargets() {
+		chain, err := loadChain(target.path)
+		if err != nil || len(chain) < 2 {
+			// 还没有证书, 或证书链中没有签发者
+			continue
+		}
+		status, err := checkRevocation(chain[0], chain[1], httpClient)
+		if err != nil {
+			log.Printf("Config %s: error checking revocation of %s: %v\n", aconfig.Id, target.path, err)
+		}
+		if status != nil && status.Status == engine.RevocationRevoked {
+			log.Printf("Config %s: certificate %s was revoked at %s\n", aconfig.Id, target.path, status.RevokedAt)
+			enqueueJob(aconfig.Id, fmt.Sprintf("certificate was revoked at %s", status.RevokedAt.Format(time.RFC3339)))
+		}
+	}
+}
+
+// checkRevocationLoop 定期检查所有配置的证书是否被吊销
+func checkRevocationLoop(interval time.Duration) {
+	for {
+		for _, conf := range listAcmeConfigs() {
+			checkConfigRevocation(conf)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/eggsampler/acme/v3"
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+// selfConf 是服务自身 https 证书的配置, 设置了 SelfHostname 时生成, 不出现在 /api/configs 中
+var selfConf *AcmeConfig
+
+// initSelfProvision 设置了 SelfHostname 时, 准备为服务自身签发证书的配置
+func initSelfProvision() error {
+	if selfHostname == "" {
+		return nil
+	}
+	switch selfChallenge {
+	case acme.ChallengeTypeHTTP01:
+		if enableHttp01 != "true" {
+			return fmt.Errorf("SelfChallenge http-01 needs EnableHttp01")
+		}
+	case acme.ChallengeTypeTLSALPN01:
+	default:
+		return fmt.Errorf("SelfChallenge %q is not supported, use http-01 or tls-alpn-01", selfChallenge)
+	}
+	if certPath == "" || keyPath == "" {
+		certPath = filepath.Join("self", selfHostname, "cert.pem")
+		keyPath = filepath.Join("self", selfHostname, "privkey.pem")
+	}
+	if selfAccountFile == "" {
+		selfAccountFile = certPath + ".account.json"
+	}
+	selfConf = &AcmeConfig{
+		Id:           "self",
+		DirectoryUrl: selfDirectoryUrl,
+		Domains:      selfHostname,
+		CertPath:     certPath,
+		KeyPath:      keyPath,
+		challenge:    selfChallenge,
+	}
+	if errs := selfConf.validate(); len(errs) > 0 {
+		return fmt.Errorf("self provisioning config is not valid: %v", errs)
+	}
+	raw, err := os.ReadFile(selfAccountFile)
+	if err == nil {
+		var account Account
+		if err := json.Unmarshal(raw, &account); err != nil {
+			return fmt.Errorf("error parsing self account file %q: %v", selfAccountFile, err)
+		}
+		selfConf.Accounts = map[string]*Account{selfConf.directoryUrls()[0]: &account}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("error reading self account file %q: %v", selfAccountFile, err)
+	}
+	return nil
+}
+
+// saveSelfAccount 保存新建的账户, 续期时不再创建账户
+func saveSelfAccount() {
+	account := selfConf.lockedAccount(selfConf.directoryUrls()[0])
+	if account == nil {
+		return
+	}
+	raw, err := json.MarshalIndent(account, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding self account: %v\n", err)
+		return
+	}
+	if err := os.WriteFile(selfAccountFile, raw, 0600); err != nil {
+		log.Printf("Error saving self account: %v\n", err)
+	}
+}
+
+// selfRenewAt 返回服务证书需要签发的时间, 证书不存在, 无法读取或不包括 SelfHostname 时立即签发
+func selfRenewAt() time.Time {
+	if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+		return time.Time{}
+	}
+	cert, err := loadLeaf(certPath)
+	if err != nil || cert.VerifyHostname(selfHostname) != nil {
+		return time.Time{}
+	}
+	// TlsCert 装订 OCSP 响应时会查询吊销状态
+	if status := cachedRevocation(cert); status != nil && status.Status == engine.RevocationRevoked {
+		log.Printf("Self certificate was revoked at %s\n", status.RevokedAt)
+		return time.Time{}
+	}
+	return engine.RenewalTime(cert)
+}
+
+// selfProvisionLoop 像 autocert 一样签发并续期服务自身的证书, 签发后 TlsCert 立即换用新证书
+func selfProvisionLoop() {
+	const minRetry, maxRetry = 5 * time.Minute, 6 * time.Hour
+	retry := minRetry
+	for {
+		if wait := time.Until(selfRenewAt()); wait > 0 {
+			// 最多等待一小时, 以便及时发现证书被吊销
+			time.Sleep(min(wait, time.Hour))
+			continue
+		}
+		log.Printf("Issuing self certificate for %s\n", selfHostname)
+		err := issueCert(selfConf, nil, log.Writer())
+		saveSelfAccount()
+		if err == nil && time.Until(selfRenewAt()) <= 0 {
+			// 签发成功但证书仍不可用(例如不含 selfHostname 或立即需要续期), 同样退避, 避免不停签发
+			err = fmt.Errorf("the issued certificate at %s is not usable for %s", certPath, selfHostname)
+		}
+		if err == nil {
+			retry = minRetry
+			continue
+		}
+		log.Printf("Error issuing self certificate, retrying in %s: %v\n", retry, err)
+		time.Sleep(retry)
+		if retry *= 2; retry > maxRetry {
+			retry = maxRetry
+		}
+	}
+}
+
+// selfSignedCert 生成临时的自签名证书, 在签发服务证书前使用
+func selfSignedCert(hostname string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error generating self-signed key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(7 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating self-signed certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
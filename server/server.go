@@ -3,25 +3,34 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/bddjr/hlfhr"
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+	"github.com/nicennnnnnnlee/cert_bot/httpclient"
 )
 
 var (
 	UrlPrefix             = GetEnvOr("UrlPrefix", "/xx")
 	bindAddr              = GetEnvOr("BindAddr", "127.0.0.1:8080")
+	bindUnix              = GetEnvOr("BindUnix", "")
+	bindUnixMode          = GetEnvOr("BindUnixMode", "0660")
 	proxyURL              = GetEnvOr("ProxyUrl", "")
+	caBundle              = GetEnvOr("CaBundle", "")
+	httpTimeout           = GetEnvOr("HttpTimeout", "30s")
+	userAgent             = GetEnvOr("UserAgent", "")
 	certPath              = GetEnvOr("CertPath", "")
 	keyPath               = GetEnvOr("KeyPath", "")
-	oauthSalt             = GetEnvOr("OAuthSalt", RandomString(64))
+	oauthSalt             = GetEnvOr("OAuthSalt", "")
 	oauthCookieFormat     = GetEnvOr("OAuthCookieFormat", `%s=%s; domain=%s; path=%s; max-age=%s; secure; HttpOnly; SameSite=Lax`)
 	oauthCookieNamePrefix = GetEnvOr("OAuthCookieNamePrefix", "crtbot")
 	oauthCookiePath       = GetEnvOr("OAuthCookiePath", UrlPrefix)
@@ -30,18 +39,62 @@ var (
 	oauthClientId         = GetEnvOr("OAuthClientId", "")
 	oauthClientSecret     = GetEnvOr("OAuthClientSecret", "")
 	oauthValidUsers       = GetEnvOr("OAuthValidUsers", "")
+	oauthValidGroups      = GetEnvOr("OAuthValidGroups", "")
+	oauthProviderName     = GetEnvOr("OAuthProvider", "github")
+	oauthIssuer           = GetEnvOr("OAuthIssuer", "")
+	oauthScopes           = GetEnvOr("OAuthScopes", "")
+	oauthUserClaim        = GetEnvOr("OAuthUserClaim", "")
+	oauthGroupsClaim      = GetEnvOr("OAuthGroupsClaim", "")
+	oauthRedirectUri      = GetEnvOr("OAuthRedirectUrl", "")
 	enableHttp01          = GetEnvOr("EnableHttp01", "true")
 	bindAddrHttp01        = GetEnvOr("BindAddrHttp01", "127.0.0.1:8081")
 	webRootHttp01         = GetEnvOr("WebRootHttp01", "")
+	enableTlsAlpn01       = GetEnvOr("EnableTlsAlpn01", "false")
+	bindAddrTlsAlpn01     = GetEnvOr("BindAddrTlsAlpn01", "127.0.0.1:8443")
+	reissueCheckInterval  = GetEnvOr("ReissueCheckInterval", "1h")
+	renewCheckInterval    = GetEnvOr("RenewCheckInterval", "0")
+	certReloadInterval    = GetEnvOr("CertReloadInterval", "1m")
+	tlsMinVersion         = GetEnvOr("TlsMinVersion", "1.2")
+	tlsMaxVersion         = GetEnvOr("TlsMaxVersion", "")
+	tlsCipherSuites       = GetEnvOr("TlsCipherSuites", "")
+	tlsCurves             = GetEnvOr("TlsCurves", "")
+	tlsAlpn               = GetEnvOr("TlsAlpn", "h2,http/1.1")
+	tlsTicketRotation     = GetEnvOr("TlsTicketRotation", "")
+	hsts                  = GetEnvOr("Hsts", "")
+	revocationInterval    = GetEnvOr("RevocationCheckInterval", "1h")
+	ocspStapling          = GetEnvOr("OcspStapling", "true")
+	selfHostname          = GetEnvOr("SelfHostname", "")
+	selfDirectoryUrl      = GetEnvOr("SelfDirectoryUrl", "letsencrypt")
+	selfChallenge         = GetEnvOr("SelfChallenge", "http-01")
+	selfAccountFile       = GetEnvOr("SelfAccountFile", "")
+	dnsServer             = GetEnvOr("DnsServer", "1.1.1.1:53")
+	configsFile           = GetEnvOr("ConfigsFile", "")
+	ledgerFile            = GetEnvOr("LedgerFile", "")
+	rateLimitMode         = GetEnvOr("RateLimitMode", "refuse")
+	clientCaFile          = GetEnvOr("ClientCaFile", "")
+	clientAuth            = GetEnvOr("ClientAuth", "optional")
+	clientCertUsers       = GetEnvOr("ClientCertUsers", "")
+	tokensFile            = GetEnvOr("TokensFile", "")
+	sessionsFile          = GetEnvOr("SessionsFile", "")
 	oauthValidHashes      map[string]interface{}
+	oauthValidGroupSet    map[string]interface{}
 
-	bNeedOAuth = isNeedOAuth()
+	bNeedOAuth      = isNeedOAuth()
+	bNeedClientCert = isNeedClientCert()
 
 	uTest        = UrlPrefix + "/api/test"
 	uOAuth       = UrlPrefix + "/api/oauth"
 	uConfig      = UrlPrefix + "/api/config"
 	uConfigs     = UrlPrefix + "/api/configs"
 	uCertReq     = UrlPrefix + "/api/req"
+	uCheck       = UrlPrefix + "/api/check"
+	uJobs        = UrlPrefix + "/api/jobs"
+	uJob         = UrlPrefix + "/api/job"
+	uApprove     = UrlPrefix + "/api/approve"
+	uTokens      = UrlPrefix + "/api/tokens"
+	uSession     = UrlPrefix + "/api/session"
+	uSessions    = UrlPrefix + "/api/sessions"
+	uLogout      = UrlPrefix + "/api/logout"
 	uNginxReload = UrlPrefix + "/api/scripts/nginx"
 	uStatic      = UrlPrefix + "/static/"
 )
@@ -53,11 +106,22 @@ func init() {
 		oauthCookieTTLInt64 = 3600
 	}
 	http.HandleFunc(uTest, test)
-	http.HandleFunc(uOAuth, oauth)
-	http.HandleFunc(uConfig, AuthHF(handleConfig))
-	http.HandleFunc(uConfigs, AuthHF(getConfigs))
-	http.HandleFunc(uCertReq, AuthHF(doCertReq))
-	http.HandleFunc(uNginxReload, AuthHF(handleShell("nginx", "-s", "reload")))
+	if bNeedOAuth {
+		// 未开启 OAuth 时没有签名密钥和 oauthProvider
+		http.HandleFunc(uOAuth, oauth)
+	}
+	http.HandleFunc(uConfig, TokenHF(ScopeConfigsRead, ScopeConfigsWrite, true, handleConfig))
+	http.HandleFunc(uConfigs, TokenHF(ScopeConfigsRead, ScopeConfigsRead, false, getConfigs))
+	http.HandleFunc(uCertReq, TokenHF(ScopeIssue, ScopeIssue, true, CsrfHF(doCertReq)))
+	http.HandleFunc(uCheck, TokenHF(ScopeConfigsRead, ScopeConfigsRead, true, handleCheck))
+	http.HandleFunc(uJobs, TokenHF(ScopeConfigsRead, ScopeConfigsRead, false, getJobs))
+	http.HandleFunc(uJob, TokenHF(ScopeConfigsRead, ScopeConfigsRead, false, getJobLog))
+	http.HandleFunc(uApprove, TokenHF(ScopeIssue, ScopeIssue, true, approveReissue))
+	http.HandleFunc(uTokens, AuthHF(handleTokens))
+	http.HandleFunc(uSession, AuthHF(handleSession))
+	http.HandleFunc(uSessions, AuthHF(handleSessions))
+	http.HandleFunc(uLogout, AuthHF(handleLogout))
+	http.HandleFunc(uNginxReload, TokenHF(ScopeScripts, ScopeScripts, false, CsrfHF(handleShell("nginx", "-s", "reload"))))
 	// http.HandleFunc(UrlPrefix+"/api/scripts/test_win", handleShell("cmd", "/c", "dir", "/b"))
 	http.HandleFunc(uStatic, AuthH(handlerStaticFS()))
 }
@@ -74,7 +138,7 @@ func GetEnvOr(key string, defaultVal string) string {
 func newServerForHttp01Only() (*http.Server, error) {
 	fs := http.FileServer(http.Dir(webRootHttp01))
 	mux := http.NewServeMux()
-	mux.Handle("/", fs)
+	mux.Handle("/", http01Responder.Handler(fs))
 	s := &http.Server{
 		Addr:    bindAddrHttp01,
 		Handler: mux,
@@ -84,14 +148,66 @@ func newServerForHttp01Only() (*http.Server, error) {
 
 func startServer(s *http.Server) error {
 	if certPath != "" && keyPath != "" {
+		interval, err := time.ParseDuration(certReloadInterval)
+		if err != nil {
+			return fmt.Errorf("CertReloadInterval %q is not valid: %v", certReloadInterval, err)
+		}
 		tlsCert := &TlsCert{
 			CertPath:       certPath,
 			KeyPath:        keyPath,
-			AttempDuration: time.Minute * 5,
+			AttempDuration: interval,
+			Pairs:          configCertPairs,
+		}
+		if selfConf != nil {
+			fallback, err := selfSignedCert(selfHostname)
+			if err != nil {
+				return err
+			}
+			tlsCert.Fallback = fallback
+		}
+		tlsConfig, err := newServerTlsConfig()
+		if err != nil {
+			return err
+		}
+		getCert := tlsCert.GetCertFunc()
+		// tls-alpn-01 验证也可以直接连接到本服务
+		tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if engine.IsChallenge(hello) {
+				return tlsAlpn01Responder.GetCertificate(hello)
+			}
+			return getCert(hello)
+		}
+		if !slices.Contains(tlsConfig.NextProtos, "h2") {
+			// 非 nil 的空表关闭 HTTP/2
+			s.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		}
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, engine.ACMETLS1Protocol)
+		if err := setClientAuth(tlsConfig); err != nil {
+			return err
+		}
+		if tlsConfig.ClientAuth != tls.NoClientCert {
+			// CA 的 tls-alpn-01 验证不会提供客户端证书
+			challengeConfig := tlsConfig.Clone()
+			challengeConfig.ClientAuth = tls.NoClientCert
+			// 副本不会跟随 TlsTicketRotation 轮换密钥, CA 的验证也不需要恢复会话
+			challengeConfig.SessionTicketsDisabled = true
+			tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				if engine.IsChallenge(hello) {
+					return challengeConfig, nil
+				}
+				return nil, nil
+			}
 		}
-		s.TLSConfig = &tls.Config{
-			GetCertificate: tlsCert.GetCertFunc(),
+		s.TLSConfig = tlsConfig
+		if hsts != "" {
+			handler := s.Handler
+			if handler == nil {
+				handler = http.DefaultServeMux
+			}
+			s.Handler = hstsHandler(handler)
 		}
+		setServerTlsCert(tlsCert)
+		go tlsCert.Watch()
 
 		l, err := net.Listen("tcp", s.Addr)
 		if err != nil {
@@ -101,8 +217,11 @@ func startServer(s *http.Server) error {
 
 		// Use hlfhr.NewListener
 		l = hlfhr.NewListener(l, s, nil)
-		return s.ServeTLS(l, "", "")
+		return s.Serve(tlsListener(l, s))
 	} else {
+		if bNeedClientCert {
+			return fmt.Errorf("ClientCaFile needs an HTTPS server, set CertPath and KeyPath or SelfHostname")
+		}
 		return s.ListenAndServe()
 	}
 }
@@ -116,8 +235,31 @@ func (exitSig) Signal() {}
 
 func Main() {
 
-	log.Println("Running service at " + bindAddr)
-	initProxyUrl(proxyURL)
+	if bindAddr == "" && bindUnix == "" {
+		log.Fatalln("BindAddr or BindUnix should be set")
+	}
+	if bindAddr != "" {
+		log.Println("Running service at " + bindAddr)
+	}
+	// 所有对外的 http 请求(CA, DNS服务商, OAuth)都使用这些默认选项
+	if err := httpclient.SetDefault(httpclient.Options{
+		CABundle:  caBundle,
+		Proxy:     proxyURL,
+		Timeout:   httpTimeout,
+		UserAgent: userAgent,
+	}); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if err := initSelfProvision(); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if err := loadConfigs(); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if err := loadTokens(); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	resumePendingOrders()
 	server := &http.Server{
 		Addr: bindAddr,
 	}
@@ -125,6 +267,15 @@ func Main() {
 
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	// SIGHUP 时重新加载 https 服务的证书
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go func() {
+		for range hupCh {
+			log.Println("Received SIGHUP, reloading certificates")
+			reloadTlsCert()
+		}
+	}()
 
 	if enableHttp01 == "true" {
 		log.Println("Running http01 challenge service at " + bindAddrHttp01)
@@ -138,13 +289,57 @@ func Main() {
 		}()
 	}
 
-	go func() {
-		if err := startServer(server); err != nil {
-			// panic(err)
-			log.Println(err)
-			signalCh <- exitSig{}
+	var listenerForTlsAlpn01 net.Listener
+	if enableTlsAlpn01 == "true" {
+		log.Println("Running tls-alpn-01 challenge service at " + bindAddrTlsAlpn01)
+		l, err := net.Listen("tcp", bindAddrTlsAlpn01)
+		if err != nil {
+			log.Fatalf("TlsAlpn01 listen failed: %v\n", err)
 		}
-	}()
+		listenerForTlsAlpn01 = l
+		go tlsAlpn01Responder.Serve(l)
+	}
+
+	if interval, err := time.ParseDuration(reissueCheckInterval); err == nil && interval > 0 {
+		go checkDomainsLoop(interval)
+	}
+	if interval, err := time.ParseDuration(renewCheckInterval); err == nil && interval > 0 {
+		go renewLoop(interval)
+	}
+	if interval, err := time.ParseDuration(revocationInterval); err == nil && interval > 0 {
+		go checkRevocationLoop(interval)
+	}
+
+	if selfConf != nil {
+		log.Println("Provisioning the server certificate for " + selfHostname)
+		go selfProvisionLoop()
+	}
+
+	if bindAddr != "" {
+		go func() {
+			if err := startServer(server); err != nil {
+				// panic(err)
+				log.Println(err)
+				signalCh <- exitSig{}
+			}
+		}()
+	}
+
+	var serverForUnix *http.Server
+	if bindUnix != "" {
+		log.Println("Running service at unix:" + bindUnix)
+		l, err := listenUnix(bindUnix, bindUnixMode)
+		if err != nil {
+			log.Fatalf("Unix socket listen failed: %v\n", err)
+		}
+		serverForUnix = newServerForUnix()
+		go func() {
+			if err := serverForUnix.Serve(l); err != nil {
+				log.Println(err)
+				signalCh <- exitSig{}
+			}
+		}()
+	}
 
 	sig := <-signalCh
 	log.Printf("Received signal: %v\n", sig)
@@ -152,11 +347,19 @@ func Main() {
 	if err := server.Shutdown(context.Background()); err != nil {
 		log.Fatalf("Server shutdown failed: %v\n", err)
 	}
+	if serverForUnix != nil {
+		if err := serverForUnix.Shutdown(context.Background()); err != nil {
+			log.Fatalf("ServerForUnix shutdown failed: %v\n", err)
+		}
+	}
 	if serverForHttp01 != nil {
 		if err := serverForHttp01.Shutdown(context.Background()); err != nil {
 			log.Fatalf("ServerForHttp01 shutdown failed: %v\n", err)
 		}
 	}
+	if listenerForTlsAlpn01 != nil {
+		listenerForTlsAlpn01.Close()
+	}
 	log.Println("Server shutdown gracefully")
 
 }
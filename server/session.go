@@ -0,0 +1,354 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nicennnnnnnlee/cert_bot/idp"
+)
+
+// Session 是 OAuth 登录后的会话, cookie 中只有签名的 id, 会话本身保存在服务端以便吊销
+type Session struct {
+	Id       string    `json:"id"`
+	User     string    `json:"user"`
+	Groups   []string  `json:"groups,omitempty"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	LastSeen time.Time `json:"lastSeen"`
+	Addr     string    `json:"addr,omitempty"`
+}
+
+// sessionsState 是 SessionsFile 的内容
+type sessionsState struct {
+	Key      string              `json:"key"`
+	Sessions map[string]*Session `json:"sessions"`
+}
+
+var (
+	sessionKey []byte
+	sessions   = make(map[string]*Session)
+	sessionsMu sync.Mutex
+)
+
+// csrfHeader 是 cookie 认证的请求修改数据时须带的 header, 值由 /api/session 返回
+const csrfHeader = "X-CSRF-Token"
+
+// initSessions 读取 SessionsFile, 签名密钥依次取自 OAuthSalt, SessionsFile 和随机生成
+func initSessions() error {
+	state := sessionsState{Sessions: make(map[string]*Session)}
+	if sessionsFile != "" {
+		raw, err := os.ReadFile(sessionsFile)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error reading sessions file %q: %v", sessionsFile, err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(raw, &state); err != nil {
+				return fmt.Errorf("error parsing sessions file %q: %v", sessionsFile, err)
+			}
+		}
+	}
+	var key []byte
+	switch {
+	case oauthSalt != "":
+		mac := hmac.New(sha256.New, []byte(oauthSalt))
+		mac.Write([]byte("cert_bot session key"))
+		key = mac.Sum(nil)
+	case state.Key != "":
+		var err error
+		if key, err = base64.StdEncoding.DecodeString(state.Key); err != nil || len(key) < 32 {
+			return fmt.Errorf("error parsing the key of sessions file %q", sessionsFile)
+		}
+	default:
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return fmt.Errorf("error generating session key: %v", err)
+		}
+		if sessionsFile == "" {
+			log.Println("Neither 'OAuthSalt' nor 'SessionsFile' is set, sessions are lost on restart")
+		}
+	}
+	now := time.Now()
+	sessionsMu.Lock()
+	sessionKey = key
+	sessions = make(map[string]*Session)
+	for id, s := range state.Sessions {
+		if s != nil && now.Before(s.Expires) {
+			sessions[id] = s
+		}
+	}
+	sessionsMu.Unlock()
+	if sessionsFile != "" && state.Key == "" && oauthSalt == "" {
+		saveSessions()
+	}
+	return nil
+}
+
+// saveSessions 把密钥和未过期的会话写入 SessionsFile, 未设置时只保存在内存中
+func saveSessions() {
+	if sessionsFile == "" {
+		return
+	}
+	state := sessionsState{Sessions: make(map[string]*Session)}
+	now := time.Now()
+	sessionsMu.Lock()
+	if oauthSalt == "" {
+		state.Key = base64.StdEncoding.EncodeToString(sessionKey)
+	}
+	for id, s := range sessions {
+		if now.Before(s.Expires) {
+			state.Sessions[id] = s
+		}
+	}
+	raw, err := json.MarshalIndent(&state, "", "  ")
+	sessionsMu.Unlock()
+	if err != nil {
+		log.Printf("Error encoding sessions: %v\n", err)
+		return
+	}
+	tmp := sessionsFile + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		log.Printf("Error saving sessions: %v\n", err)
+		return
+	}
+	if err := os.Rename(tmp, sessionsFile); err != nil {
+		log.Printf("Error saving sessions: %v\n", err)
+	}
+}
+
+func sessionMac(purpose string, payload string) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(purpose + "." + payload))
+	return mac.Sum(nil)
+}
+
+// signValue 把 v 编码为 "payload.hmac", purpose 区分不同用途的签名, 一种用途的值不能用于另一种
+func signValue(purpose string, v interface{}) string {
+	raw, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sessionMac(purpose, payload))
+}
+
+// verifyValue 校验 signValue 的签名并解码到 v
+func verifyValue(purpose string, signed string, v interface{}) bool {
+	if len(sessionKey) == 0 {
+		return false
+	}
+	payload, sig, ok := strings.Cut(signed, ".")
+	if !ok {
+		return false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, sessionMac(purpose, payload)) {
+		return false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(raw, v) == nil
+}
+
+// sessionCookie 是会话 cookie 的内容
+type sessionCookie struct {
+	Id      string `json:"sid"`
+	Expires int64  `json:"exp"`
+}
+
+// newSession 为登录的用户创建会话, 返回 cookie 的值
+func newSession(r *http.Request, id *idp.Identity) (*Session, string) {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	now := time.Now()
+	s := &Session{
+		Id:       hex.EncodeToString(raw),
+		User:     id.User,
+		Groups:   id.Groups,
+		Created:  now,
+		Expires:  now.Add(time.Duration(oauthCookieTTLInt64) * time.Second),
+		LastSeen: now,
+		Addr:     r.RemoteAddr,
+	}
+	sessionsMu.Lock()
+	sessions[s.Id] = s
+	sessionsMu.Unlock()
+	saveSessions()
+	return s, signValue("session", &sessionCookie{Id: s.Id, Expires: s.Expires.Unix()})
+}
+
+// requestSession 返回 cookie 对应的有效会话, 用户须仍在 OAuthValidUsers 或 OAuthValidGroups 中
+func requestSession(r *http.Request) *Session {
+	c, err := r.Cookie(oauthCookieNamePrefix + "_s")
+	if err != nil {
+		return nil
+	}
+	var sc sessionCookie
+	if !verifyValue("session", c.Value, &sc) {
+		return nil
+	}
+	now := time.Now()
+	if now.Unix() >= sc.Expires {
+		return nil
+	}
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s := sessions[sc.Id]
+	if s == nil || !now.Before(s.Expires) {
+		return nil
+	}
+	if !oauthAllowed(&idp.Identity{User: s.User, Groups: s.Groups}) {
+		return nil
+	}
+	s.LastSeen = now
+	return s
+}
+
+// revokeSessions 删除 id 对应的会话, id 为空时删除 user 的所有会话, 返回删除的个数
+func revokeSessions(id string, user string) int {
+	n := 0
+	sessionsMu.Lock()
+	for sid, s := range sessions {
+		if (id != "" && sid == id) || (id == "" && strings.EqualFold(s.User, user)) {
+			delete(sessions, sid)
+			n++
+		}
+	}
+	sessionsMu.Unlock()
+	if n > 0 {
+		saveSessions()
+	}
+	return n
+}
+
+func csrfToken(s *Session) string {
+	return base64.RawURLEncoding.EncodeToString(sessionMac("csrf", s.Id))
+}
+
+type sessionKeyType struct{}
+
+func contextSession(r *http.Request) *Session {
+	s, _ := r.Context().Value(sessionKeyType{}).(*Session)
+	return s
+}
+
+func withSession(r *http.Request, s *Session) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionKeyType{}, s))
+}
+
+// checkCsrf 判断通过会话 cookie 认证的请求是否带了正确的 X-CSRF-Token,
+// 通过客户端证书认证的请求须是同源的; API token 等其它认证方式不需要
+func checkCsrf(r *http.Request) bool {
+	s := contextSession(r)
+	if s == nil {
+		if _, ok := r.Context().Value(clientCertKeyType{}).(string); ok {
+			return sameOrigin(r)
+		}
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(csrfToken(s))) == 1
+}
+
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+func writeCsrfError(w http.ResponseWriter) {
+	writeAuthError(w, http.StatusForbidden, 4014, "The "+csrfHeader+" header is missing or not valid, or the request is cross-site")
+}
+
+// CsrfHF 用于会修改数据的 GET 接口, 例如请求证书; 其它方法的请求已由 AuthHF 检查
+func CsrfHF(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkCsrf(r) {
+			writeCsrfError(w)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	hostWithoutPort, _ := splitHostPort(r.Host)
+	w.Header().Add("Set-Cookie", fmt.Sprintf(oauthCookieFormat, oauthCookieNamePrefix+"_s", "", hostWithoutPort, oauthCookiePath, "0"))
+}
+
+// handleSession 返回当前会话和修改数据时须带的 X-CSRF-Token
+func handleSession(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	result := &HttpResult{Err: 4015, Data: "Not logged in with OAuth"}
+	if s := contextSession(r); s != nil {
+		result = &HttpResult{Err: 2000, Data: map[string]interface{}{
+			"id":      s.Id,
+			"user":    s.User,
+			"expires": s.Expires,
+			"csrf":    csrfToken(s),
+		}}
+	}
+	bytes, _ := json.Marshal(result)
+	w.Write(bytes)
+}
+
+// handleLogout 吊销当前会话并删除 cookie
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	result := &HttpResult{Err: 4009, Data: "Method not allowed"}
+	if r.Method == "POST" {
+		if s := contextSession(r); s != nil {
+			revokeSessions(s.Id, "")
+			log.Println("logout:", s.User)
+		}
+		clearSessionCookie(w, r)
+		result = &HttpResult{Err: 2000, Data: "ok"}
+	}
+	bytes, _ := json.Marshal(result)
+	w.Write(bytes)
+}
+
+// handleSessions 管理会话: GET 列出, DELETE 按 id 或 user 吊销
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	errCode, data := _handleSessions(r)
+	bytes, _ := json.Marshal(&HttpResult{Err: errCode, Data: data})
+	w.Write(bytes)
+}
+
+func _handleSessions(r *http.Request) (int, interface{}) {
+	switch r.Method {
+	case "GET":
+		now := time.Now()
+		sessionsMu.Lock()
+		list := make([]Session, 0, len(sessions))
+		for _, s := range sessions {
+			if now.Before(s.Expires) {
+				list = append(list, *s)
+			}
+		}
+		sessionsMu.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+		return 2000, list
+	case "DELETE":
+		id, user := r.URL.Query().Get("id"), r.URL.Query().Get("user")
+		if id == "" && user == "" {
+			return 4003, map[string]interface{}{"id": "id or user should be set"}
+		}
+		n := revokeSessions(id, user)
+		if n == 0 {
+			return 4000, "No session matched!!!"
+		}
+		return 2000, n
+	}
+	return 4009, "Method not allowed"
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nicennnnnnnlee/cert_bot/idp"
+)
+
+// setupTestSessions turns OAuth on with alice as the only valid user
+func setupTestSessions(t *testing.T) {
+	needOAuth, salt, file, hashes := bNeedOAuth, oauthSalt, sessionsFile, oauthValidHashes
+	t.Cleanup(func() {
+		bNeedOAuth, oauthSalt, sessionsFile, oauthValidHashes = needOAuth, salt, file, hashes
+		sessionKey = nil
+	})
+	bNeedOAuth, oauthSalt, sessionsFile = true, "test-salt", ""
+	oauthValidHashes = map[string]interface{}{HashMd5("alice"): nil}
+	if err := initSessions(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sessionRequest(method string, target string, cookie string, csrf string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.AddCookie(&http.Cookie{Name: oauthCookieNamePrefix + "_s", Value: cookie})
+	if csrf != "" {
+		r.Header.Set(csrfHeader, csrf)
+	}
+	return r
+}
+
+func serveResult(h http.HandlerFunc, r *http.Request) (int, HttpResult) {
+	w := httptest.NewRecorder()
+	h(w, r)
+	var result HttpResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return w.Code, result
+}
+
+// go test ./server -v -run TestSessionCsrf
+func TestSessionCsrf(t *testing.T) {
+	setupTestSessions(t)
+	s, cookie := newSession(httptest.NewRequest("GET", "/", nil), &idp.Identity{User: "Alice"})
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		bytes, _ := json.Marshal(&HttpResult{Err: 2000, Data: contextSession(r).User})
+		w.Write(bytes)
+	}
+	h := AuthHF(ok)
+
+	if _, result := serveResult(h, sessionRequest("GET", "/api/configs", cookie, "")); result.Err != 2000 {
+		t.Errorf("GET with a session: %+v", result)
+	}
+	if code, result := serveResult(h, sessionRequest("POST", "/api/config", cookie, "")); code != 403 || result.Err != 4014 {
+		t.Errorf("POST without csrf token: %d %+v", code, result)
+	}
+	if code, _ := serveResult(h, sessionRequest("POST", "/api/config", cookie, "wrong")); code != 403 {
+		t.Errorf("POST with a wrong csrf token: %d", code)
+	}
+	if _, result := serveResult(h, sessionRequest("POST", "/api/config", cookie, csrfToken(s))); result.Err != 2000 {
+		t.Errorf("POST with csrf token: %+v", result)
+	}
+	// GET apis that change data, like /api/req, need the token too
+	if code, _ := serveResult(AuthHF(CsrfHF(ok)), sessionRequest("GET", "/api/req?id=a", cookie, "")); code != 403 {
+		t.Errorf("CsrfHF without csrf token: %d", code)
+	}
+
+	if requestSession(sessionRequest("GET", "/", cookie+"x", "")) != nil {
+		t.Error("a tampered cookie should not be accepted")
+	}
+	payload, _, _ := strings.Cut(cookie, ".")
+	if requestSession(sessionRequest("GET", "/", payload+"."+strings.Repeat("A", 43), "")) != nil {
+		t.Error("a cookie with a forged mac should not be accepted")
+	}
+	oauthValidHashes = map[string]interface{}{}
+	if requestSession(sessionRequest("GET", "/", cookie, "")) != nil {
+		t.Error("the session of a user no longer valid should not be accepted")
+	}
+}
+
+// go test ./server -v -run TestLogout
+func TestLogout(t *testing.T) {
+	setupTestSessions(t)
+	s, cookie := newSession(httptest.NewRequest("GET", "/", nil), &idp.Identity{User: "alice"})
+	h := AuthHF(handleLogout)
+
+	w := httptest.NewRecorder()
+	h(w, sessionRequest("POST", "/api/logout", cookie, csrfToken(s)))
+	if !strings.Contains(w.Body.String(), `"err":2000`) {
+		t.Fatalf("logout: %s", w.Body)
+	}
+	if !strings.Contains(w.Header().Get("Set-Cookie"), oauthCookieNamePrefix+"_s=;") {
+		t.Errorf("the session cookie should be cleared, got %q", w.Header().Get("Set-Cookie"))
+	}
+	if requestSession(sessionRequest("GET", "/", cookie, "")) != nil {
+		t.Error("the session should be revoked after logout")
+	}
+}
+
+// go test ./server -v -run TestOAuthDisabled
+func TestOAuthDisabled(t *testing.T) {
+	if _, pattern := http.DefaultServeMux.Handler(httptest.NewRequest("GET", uOAuth+"?code=c&state=s", nil)); pattern == uOAuth {
+		t.Error("the oauth callback should not be registered without OAuth")
+	}
+	sessionKey = nil
+	// without OAuth there is no key, a value signed with the empty key must not pass
+	signed := signValue("oauth", &oauthState{State: "s"})
+	var st oauthState
+	if verifyValue("oauth", signed, &st) {
+		t.Fatal("values should not be verified without a session key")
+	}
+}
+
+// go test ./server -v -run TestClientCertCsrf
+func TestClientCertCsrf(t *testing.T) {
+	needCert, users := bNeedClientCert, clientCertValidUsers
+	t.Cleanup(func() { bNeedClientCert, clientCertValidUsers = needCert, users })
+	bNeedClientCert, clientCertValidUsers = true, map[string]interface{}{"deploy-bot": nil}
+	cert, err := selfSignedCert("deploy-bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := AuthHF(func(w http.ResponseWriter, r *http.Request) {
+		bytes, _ := json.Marshal(&HttpResult{Err: 2000, Data: "ok"})
+		w.Write(bytes)
+	})
+	request := func(method string, header string, value string) *http.Request {
+		r := httptest.NewRequest(method, "https://certbot.example.com/api/config", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert.Leaf}}}
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		return r
+	}
+	for _, c := range []struct {
+		method, header, value string
+		allowed               bool
+	}{
+		{"POST", "", "", true},
+		{"POST", "Sec-Fetch-Site", "same-origin", true},
+		{"POST", "Sec-Fetch-Site", "cross-site", false},
+		{"POST", "Origin", "https://certbot.example.com", true},
+		{"POST", "Origin", "https://evil.example.com", false},
+		{"GET", "Sec-Fetch-Site", "cross-site", true},
+	} {
+		if code, _ := serveResult(h, request(c.method, c.header, c.value)); (code == 200) != c.allowed {
+			t.Errorf("%s with %s: %q, expected allowed %v, got %d", c.method, c.header, c.value, c.allowed, code)
+		}
+	}
+	// GET apis that change data are checked too
+	if code, _ := serveResult(AuthHF(CsrfHF(h)), request("GET", "Sec-Fetch-Site", "cross-site")); code != 403 {
+		t.Errorf("cross-site GET of CsrfHF: %d", code)
+	}
+}
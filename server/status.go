@@ -0,0 +1,111 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+// CertStatus 是 CertPath 中证书的状态
+type CertStatus struct {
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	RenewAt   time.Time `json:"renewAt"`
+	NeedRenew bool      `json:"needRenew"`
+	Err       string    `json:"err,omitempty"`
+	// 配置了但证书中没有的名称, 和证书中多出的名称
+	Missing []string `json:"missing,omitempty"`
+	Extra   []string `json:"extra,omitempty"`
+	// 证书与配置不一致, 等待确认重新签发
+	ReissuePending bool `json:"reissuePending,omitempty"`
+	// 首选CA的剩余限额, 只有已知限额的CA才有
+	Budget *engine.Budget `json:"budget,omitempty"`
+	// 最近一次 OCSP 或 CRL 查询到的吊销状态
+	Revocation *engine.RevocationStatus `json:"revocation,omitempty"`
+}
+
+func (status *CertStatus) revoked() bool {
+	return status.Revocation != nil && status.Revocation.Status == engine.RevocationRevoked
+}
+
+// refreshStatus 更新证书状态, 有多个分片时取最先需要续期的那个
+func (aconfig *AcmeConfig) refreshStatus() {
+	var status *CertStatus
+	for _, target := range aconfig.certTargets() {
+		s := certStatus(target.path)
+		if status == nil || s.Err != "" || s.revoked() || (status.Err == "" && s.RenewAt.Before(status.RenewAt)) {
+			status = s
+		}
+		if s.Err != "" || s.revoked() {
+			break
+		}
+	}
+	status.Missing, status.Extra, _ = aconfig.domainsMismatch()
+	status.ReissuePending = aconfig.reissuePending
+	status.Budget = aconfig.configBudget()
+	aconfig.Status = status
+}
+
+func certStatus(certPath string) *CertStatus {
+	status := &CertStatus{}
+	cert, err := loadLeaf(certPath)
+	if err != nil {
+		status.Err = err.Error()
+		status.NeedRenew = true
+		return status
+	}
+	status.NotBefore = cert.NotBefore
+	status.NotAfter = cert.NotAfter
+	status.RenewAt = engine.RenewalTime(cert)
+	status.NeedRenew = time.Now().After(status.RenewAt)
+	status.Revocation = cachedRevocation(cert)
+	if status.revoked() {
+		status.NeedRenew = true
+	}
+	return status
+}
+
+// loadLeaf 读取 pem 文件中的第一个证书
+func loadLeaf(certPath string) (*x509.Certificate, error) {
+	raw, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	b, _ := pem.Decode(raw)
+	if b == nil || b.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %s", certPath)
+	}
+	return x509.ParseCertificate(b.Bytes)
+}
+
+// loadChain 读取 pem 文件中的证书链
+func loadChain(certPath string) ([]*x509.Certificate, error) {
+	raw, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	var chain []*x509.Certificate
+	for {
+		var b *pem.Block
+		b, raw = pem.Decode(raw)
+		if b == nil {
+			break
+		}
+		if b.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(b.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificate found in %s", certPath)
+	}
+	return chain, nil
+}
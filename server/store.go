@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+)
+
+// saveConfigs 把所有配置(包括账户)写入 ConfigsFile, 未设置时不保存
+func saveConfigs() {
+	if configsFile == "" {
+		return
+	}
+	configsMu.RLock()
+	raw, err := json.MarshalIndent(AcmeConfigs, "", "  ")
+	configsMu.RUnlock()
+	if err != nil {
+		log.Printf("Error encoding configs: %v\n", err)
+		return
+	}
+	tmp := configsFile + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		log.Printf("Error saving configs: %v\n", err)
+		return
+	}
+	if err := os.Rename(tmp, configsFile); err != nil {
+		log.Printf("Error saving configs: %v\n", err)
+	}
+}
+
+// loadConfigs 启动时从 ConfigsFile 读取配置
+func loadConfigs() error {
+	if configsFile == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(configsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading configs file %q: %v", configsFile, err)
+	}
+	configs := make(map[string]*AcmeConfig)
+	if err := json.Unmarshal(raw, &configs); err != nil {
+		return fmt.Errorf("error parsing configs file %q: %v", configsFile, err)
+	}
+	configsMu.Lock()
+	for id, conf := range configs {
+		conf.Status = nil
+		conf.migrateAccount()
+		AcmeConfigs[id] = conf
+	}
+	configsMu.Unlock()
+	log.Printf("Loaded %d configs from %s\n", len(configs), configsFile)
+	return nil
+}
+
+// hasPendingOrder 判断配置是否有中断的订单
+func (aconfig *AcmeConfig) hasPendingOrder() bool {
+	for _, target := range aconfig.certTargets() {
+		if _, err := os.Stat(engine.OrderStatePath(target.path)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// resumePendingOrders 为有中断订单的配置加入任务, 继续上次的订单
+func resumePendingOrders() {
+	for _, conf := range listAcmeConfigs() {
+		if conf.hasPendingOrder() {
+			enqueueJob(conf.Id, "resume interrupted order")
+		}
+	}
+}
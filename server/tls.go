@@ -1,93 +1,387 @@
 package server
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/nicennnnnnnlee/cert_bot/engine"
+	"github.com/nicennnnnnnlee/cert_bot/httpclient"
 )
 
+// CertKeyPair 是证书和私钥文件的路径
+type CertKeyPair struct {
+	CertPath string
+	KeyPath  string
+}
+
 type TlsCert struct {
-	CertPath         string
-	KeyPath          string
-	certificate      *tls.Certificate
-	certLastModified *time.Time
-	certExpireTime   *time.Time
-	lastAttemp       *time.Time
-	AttempDuration   time.Duration
+	// 默认证书, ClientHello 的 ServerName 没有匹配的证书时使用
+	CertPath string
+	KeyPath  string
+	// 检查证书文件有没有修改的间隔
+	AttempDuration time.Duration
+	// Fallback 在默认证书无法加载时代替它, 证书文件生成后自动换用; 为空时 LoadCert 会 panic
+	Fallback *tls.Certificate
+	// Pairs 返回按 SNI 选择的其它证书, 如所有 AcmeConfig 的证书, 每次检查时重新获取
+	Pairs func() []CertKeyPair
+
+	// mu 保护握手时读取的字段, reloadMu 使重新加载逐个进行, 读取文件时只持有 reloadMu
+	mu         sync.Mutex
+	reloadMu   sync.Mutex
+	def        *loadedCert
+	loaded     map[CertKeyPair]*loadedCert
+	sni        map[string]*loadedCert
+	lastAttemp *time.Time
 }
 
-func (t *TlsCert) LoadCert() {
-	now := time.Now()
-	t.lastAttemp = &now
-	_, err := t.loadCert(nil)
+// fileState 是文件的修改时间和大小, 变化时才计算 hash
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) (fileState, error) {
+	info, err := os.Stat(path)
 	if err != nil {
-		panic(err)
+		return fileState{}, err
 	}
+	return fileState{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+func (s fileState) same(other fileState) bool {
+	return s.modTime.Equal(other.modTime) && s.size == other.size
 }
 
-func (t *TlsCert) loadCert(certLastModified *time.Time) (*tls.Certificate, error) {
-	// x509.ParseCertificate()
-	cert, err := tls.LoadX509KeyPair(t.CertPath, t.KeyPath)
+// loadedCert 是已加载的一对证书和私钥
+type loadedCert struct {
+	CertKeyPair
+	certificate *tls.Certificate
+	leaf        *x509.Certificate
+	// 证书链中的签发者, 用于查询 OCSP, 链中没有时为 nil
+	issuer    *x509.Certificate
+	certState fileState
+	keyState  fileState
+	hash      [sha256.Size]byte
+	// 上一次重新加载失败的原因, 相同的错误只记录一次
+	lastErr string
+}
+
+func loadCert(pair CertKeyPair) (*loadedCert, error) {
+	certState, err := statFile(pair.CertPath)
+	if err != nil {
+		return nil, err
+	}
+	keyState, err := statFile(pair.KeyPath)
 	if err != nil {
 		return nil, err
 	}
-	x509Cert, _ := x509.ParseCertificate(cert.Certificate[0])
-	log.Println("证书过期时间: ", x509Cert.NotAfter)
-	if certLastModified == nil {
-		certFileInfo, err := os.Stat(t.CertPath)
+	certPEM, err := os.ReadFile(pair.CertPath)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(pair.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	// 证书与私钥不匹配时返回错误
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	log.Println("证书过期时间: ", pair.CertPath, x509Cert.NotAfter)
+	var issuer *x509.Certificate
+	if len(cert.Certificate) > 1 {
+		issuer, _ = x509.ParseCertificate(cert.Certificate[1])
+	}
+	return &loadedCert{
+		CertKeyPair: pair,
+		certificate: &cert,
+		leaf:        x509Cert,
+		issuer:      issuer,
+		certState:   certState,
+		keyState:    keyState,
+		hash:        sha256.Sum256(bytes.Join([][]byte{certPEM, keyPEM}, []byte{0})),
+	}, nil
+}
+
+// reload 在证书或私钥文件有过修改时重新加载, 失败时(如证书与私钥不匹配)返回旧的证书
+func (l *loadedCert) reload() *loadedCert {
+	// 检查文件有过修改
+	certState, err := statFile(l.CertPath)
+	if err != nil {
+		l.logOnce("证书不存在, 返回旧的证书:", err)
+		return l
+	}
+	keyState, err := statFile(l.KeyPath)
+	if err != nil {
+		l.logOnce("私钥不存在, 返回旧的证书:", err)
+		return l
+	}
+	if certState.same(l.certState) && keyState.same(l.keyState) {
+		return l
+	}
+	// 重新加载Cert
+	reloaded, err := loadCert(l.CertKeyPair)
+	if err != nil {
+		l.logOnce("加载新证书失败, 返回旧的证书:", err)
+		return l
+	}
+	if reloaded.hash == l.hash {
+		// 只是修改时间变了
+		l.certState, l.keyState, l.lastErr = reloaded.certState, reloaded.keyState, ""
+		return l
+	}
+	log.Println("已加载新证书:", l.CertPath)
+	return reloaded
+}
+
+func (l *loadedCert) logOnce(msg string, err error) {
+	if err.Error() == l.lastErr {
+		return
+	}
+	l.lastErr = err.Error()
+	log.Println(l.CertPath, msg, err)
+}
+
+func (t *TlsCert) LoadCert() {
+	t.reloadMu.Lock()
+	defer t.reloadMu.Unlock()
+	pair := CertKeyPair{CertPath: t.CertPath, KeyPath: t.KeyPath}
+	def, err := loadCert(pair)
+	if err != nil {
+		if t.Fallback == nil {
+			panic(err)
+		}
+		log.Println("证书无法加载, 使用临时证书:", err)
+		leaf, err := x509.ParseCertificate(t.Fallback.Certificate[0])
 		if err != nil {
-			return nil, err
+			panic(err)
 		}
-		modTime := certFileInfo.ModTime()
-		t.certLastModified = &modTime
-	} else {
-		t.certLastModified = certLastModified
+		// 文件状态为空, 证书文件出现后 reload 会加载它
+		def = &loadedCert{CertKeyPair: pair, certificate: t.Fallback, leaf: leaf}
 	}
+	t.mu.Lock()
+	t.def = def
+	t.mu.Unlock()
+	// OCSP 响应由 Watch 启动时装订, 不阻塞服务启动
+	t.refresh(time.Now())
+}
 
-	t.certExpireTime = &x509Cert.NotAfter
-	t.certificate = &cert
-	return t.certificate, nil
+// Reload 立即检查所有证书, 重新加载修改过的证书, 有新证书时立即装订 OCSP 响应
+func (t *TlsCert) Reload() {
+	if t.reload() {
+		t.Staple()
+	}
 }
 
-func (t *TlsCert) CheckCert(now *time.Time) {
-	t.lastAttemp = now
-	// // 检查证书有没有过期
-	// if !now.After(*t.certExpireTime) {
-	// 	// log.Println("证书未过期, 返回旧的证书")
-	// 	return
-	// }
-	// log.Println("证书已过期")
+func (t *TlsCert) reload() bool {
+	t.reloadMu.Lock()
+	defer t.reloadMu.Unlock()
+	return t.refresh(time.Now())
+}
 
-	// 检查文件存在
-	certFileInfo, err := os.Stat(t.CertPath)
-	if err != nil {
-		log.Println("证书不存在, 返回旧的证书:", err)
-		return
+// Watch 每隔 AttempDuration 检查一次证书文件, 并更新装订的 OCSP 响应, 须在 LoadCert 之后调用
+func (t *TlsCert) Watch() {
+	interval := t.AttempDuration
+	if interval <= 0 {
+		// 不检查证书文件时, 仍然定期更新 OCSP 响应
+		interval = time.Hour
 	}
-	// 检查文件有过修改
-	certLastModified := certFileInfo.ModTime()
-	// if !certLastModified.After(*t.certLastModified) {
-	if certLastModified.Compare(*t.certLastModified) == 0 {
-		log.Println("证书最后修改时间不合适, 返回旧的证书")
+	t.Staple()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if t.AttempDuration > 0 {
+			t.reload()
+		}
+		t.Staple()
+	}
+}
+
+// Staple 为有 OCSP 服务器的证书获取 OCSP 响应并装订到握手中, 在 NextUpdate 之前更新
+func (t *TlsCert) Staple() {
+	if ocspStapling != "true" {
 		return
 	}
-	// 重新加载Cert
-	log.Println("尝试加载新证书:", err)
-	t.loadCert(&certLastModified)
+	t.mu.Lock()
+	certs := []*loadedCert{t.def}
+	for _, l := range t.loaded {
+		certs = append(certs, l)
+	}
+	t.mu.Unlock()
+
+	for _, l := range certs {
+		if l.issuer == nil || len(l.leaf.OCSPServer) == 0 {
+			continue
+		}
+		status, err := checkRevocation(l.leaf, l.issuer, httpclient.Default())
+		if err != nil {
+			log.Println("获取 OCSP 响应失败:", l.CertPath, err)
+		}
+		var staple []byte
+		switch {
+		case status == nil || len(status.Staple) == 0:
+			// 更新失败时, 已装订的响应过期后也不再装订
+			t.mu.Lock()
+			staple = l.certificate.OCSPStaple
+			t.mu.Unlock()
+			if staple == nil {
+				continue
+			}
+			if resp, err := engine.ParseOCSPResponse(staple, l.leaf, l.issuer); err != nil || resp.Status != engine.RevocationGood {
+				staple = nil
+			}
+		case status.Status != engine.RevocationGood:
+			// 被吊销的证书由 checkRevocationLoop 重新签发, 不装订
+			log.Println("证书状态为", status.Status, ", 不装订 OCSP 响应:", l.CertPath)
+		case !status.Fresh(time.Now()):
+			log.Println("OCSP 响应已过期, 不装订:", l.CertPath)
+		default:
+			staple = status.Staple
+		}
+		t.mu.Lock()
+		if !bytes.Equal(l.certificate.OCSPStaple, staple) {
+			// 握手中可能正在使用旧的 tls.Certificate, 复制后替换
+			cert := *l.certificate
+			cert.OCSPStaple = staple
+			l.certificate = &cert
+		}
+		t.mu.Unlock()
+	}
+}
+
+// refresh 检查已加载的证书, 加载新增的证书, 并重建 SNI 表, 调用方须持有 reloadMu.
+// 读取文件时不持有 mu, 不阻塞握手, 最后一起替换. 返回是否有新加载的证书
+func (t *TlsCert) refresh(now time.Time) bool {
+	t.mu.Lock()
+	def, previous := t.def, t.loaded
+	t.mu.Unlock()
+	changed := false
+	if reloaded := def.reload(); reloaded != def {
+		def, changed = reloaded, true
+	}
+
+	var pairs []CertKeyPair
+	if t.Pairs != nil {
+		pairs = t.Pairs()
+	}
+	loaded := make(map[CertKeyPair]*loadedCert)
+	for _, pair := range pairs {
+		if pair.CertPath == "" || pair.KeyPath == "" {
+			continue
+		}
+		if _, ok := loaded[pair]; ok {
+			continue
+		}
+		if l, ok := previous[pair]; ok {
+			loaded[pair] = l.reload()
+			changed = changed || loaded[pair] != l
+			continue
+		}
+		l, err := loadCert(pair)
+		if err != nil {
+			// 还没有签发的证书不用提示
+			if !os.IsNotExist(err) {
+				log.Println("加载证书失败:", pair.CertPath, err)
+			}
+			continue
+		}
+		loaded[pair] = l
+		changed = true
+	}
+
+	sni := make(map[string]*loadedCert)
+	add := func(l *loadedCert) {
+		for _, name := range l.leaf.DNSNames {
+			name = strings.ToLower(name)
+			// 同一个名称有多张证书时, 使用过期时间最晚的
+			if prev, ok := sni[name]; ok && !l.leaf.NotAfter.After(prev.leaf.NotAfter) {
+				continue
+			}
+			sni[name] = l
+		}
+	}
+	add(def)
+	for _, l := range loaded {
+		add(l)
+	}
+	t.mu.Lock()
+	t.lastAttemp = &now
+	t.def, t.loaded, t.sni = def, loaded, sni
+	t.mu.Unlock()
+	return changed
+}
+
+// lookup 按 ServerName 选择证书: 先精确匹配, 再匹配通配符, 最后使用默认证书
+func (t *TlsCert) lookup(serverName string) *loadedCert {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if name == "" {
+		return t.def
+	}
+	if l, ok := t.sni[name]; ok {
+		return l
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if l, ok := t.sni["*"+name[i:]]; ok {
+			return l
+		}
+	}
+	return t.def
 }
 
 func (t *TlsCert) GetCertFunc() func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	// 初始化证书
 	t.LoadCert()
-	return func(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
-		// 不论 ClientHello ServerName是什么，都返回该证书
-		// 初始化证书  必须在这之前显式调用 t.LoadCert()
-		now := time.Now()
-		if t.lastAttemp.Add(t.AttempDuration).Before(now) && now.After(*t.certExpireTime) {
-			log.Println("证书已过期, 检查是否更新证书")
-			t.CheckCert(&now)
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return t.lookup(hello.ServerName).certificate, nil
+	}
+}
+
+// serverTlsCert 是 https 服务使用的证书, 服务是 http 时为 nil
+var (
+	serverTlsCert   *TlsCert
+	serverTlsCertMu sync.Mutex
+)
+
+func setServerTlsCert(t *TlsCert) {
+	serverTlsCertMu.Lock()
+	defer serverTlsCertMu.Unlock()
+	serverTlsCert = t
+}
+
+// reloadTlsCert 在收到 SIGHUP 或签发了新证书后, 立即重新加载 https 服务的证书
+func reloadTlsCert() {
+	serverTlsCertMu.Lock()
+	t := serverTlsCert
+	serverTlsCertMu.Unlock()
+	if t != nil {
+		t.Reload()
+	}
+}
+
+// configCertPairs 返回所有配置的证书, 使用 csr 的配置私钥不在本地, 不包括在内
+func configCertPairs() []CertKeyPair {
+	var pairs []CertKeyPair
+	for _, conf := range listAcmeConfigs() {
+		if conf.Csr != "" {
+			continue
+		}
+		for _, target := range conf.certTargets() {
+			pairs = append(pairs, CertKeyPair{CertPath: target.path, KeyPath: target.keyPath})
 		}
-		return t.certificate, nil
 	}
+	return pairs
 }
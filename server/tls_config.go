@@ -0,0 +1,176 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+var tlsVersionNames = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurveNames = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// splitList 拆分逗号分隔的列表, 忽略空项
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseTlsVersion(name string, s string) (uint16, error) {
+	if s == "" {
+		return 0, nil
+	}
+	version, ok := tlsVersionNames[s]
+	if !ok {
+		return 0, fmt.Errorf("%s %q is not valid, use 1.0, 1.1, 1.2 or 1.3", name, s)
+	}
+	return version, nil
+}
+
+// parseCipherSuites 按名称解析密码套件, 如 TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, 不接受不安全的套件
+func parseCipherSuites(s string) ([]uint16, error) {
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range splitList(s) {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("cipher suite %q is not supported or not secure", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func parseCurves(s string) ([]tls.CurveID, error) {
+	var curves []tls.CurveID
+	for _, name := range splitList(s) {
+		curve, ok := tlsCurveNames[name]
+		if !ok {
+			return nil, fmt.Errorf("curve %q is not supported, use X25519, P256, P384 or P521", name)
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
+
+func parseAlpn(s string) ([]string, error) {
+	protos := splitList(s)
+	for _, proto := range protos {
+		if proto != "h2" && proto != "http/1.1" {
+			return nil, fmt.Errorf("alpn protocol %q is not supported, use h2 or http/1.1", proto)
+		}
+	}
+	if len(protos) == 0 {
+		return nil, fmt.Errorf("TlsAlpn should not be empty")
+	}
+	return protos, nil
+}
+
+// newServerTlsConfig 根据环境变量生成 https 服务的 TLS 参数, 证书由调用者设置
+func newServerTlsConfig() (*tls.Config, error) {
+	conf := &tls.Config{}
+	var err error
+	if conf.MinVersion, err = parseTlsVersion("TlsMinVersion", tlsMinVersion); err != nil {
+		return nil, err
+	}
+	if conf.MaxVersion, err = parseTlsVersion("TlsMaxVersion", tlsMaxVersion); err != nil {
+		return nil, err
+	}
+	if conf.MaxVersion != 0 && conf.MaxVersion < conf.MinVersion {
+		return nil, fmt.Errorf("TlsMaxVersion %s is lower than TlsMinVersion %s", tlsMaxVersion, tlsMinVersion)
+	}
+	// TLS 1.3 的密码套件不可配置, 只影响 TLS 1.2 及以下
+	if conf.CipherSuites, err = parseCipherSuites(tlsCipherSuites); err != nil {
+		return nil, err
+	}
+	if conf.CurvePreferences, err = parseCurves(tlsCurves); err != nil {
+		return nil, err
+	}
+	if conf.NextProtos, err = parseAlpn(tlsAlpn); err != nil {
+		return nil, err
+	}
+	switch tlsTicketRotation {
+	case "":
+		// Go 默认每 24 小时自动轮换
+	case "off":
+		conf.SessionTicketsDisabled = true
+	default:
+		interval, err := time.ParseDuration(tlsTicketRotation)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("TlsTicketRotation %q is not valid, use a duration or off", tlsTicketRotation)
+		}
+		keys, err := rotateTicketKeys(conf, nil)
+		if err != nil {
+			return nil, err
+		}
+		go rotateTicketKeysLoop(conf, keys, interval)
+	}
+	return conf, nil
+}
+
+// rotateTicketKeys 生成新的 session ticket 密钥, 保留前两个密钥以便解密还未过期的 ticket
+func rotateTicketKeys(conf *tls.Config, keys [][32]byte) ([][32]byte, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return keys, fmt.Errorf("error generating session ticket key: %v", err)
+	}
+	keys = append([][32]byte{key}, keys...)
+	if len(keys) > 3 {
+		keys = keys[:3]
+	}
+	conf.SetSessionTicketKeys(keys)
+	return keys, nil
+}
+
+func rotateTicketKeysLoop(conf *tls.Config, keys [][32]byte, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		var err error
+		if keys, err = rotateTicketKeys(conf, keys); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// tlsListener 直接使用 s.TLSConfig 而不是 ServeTLS 复制的副本, 轮换的 session ticket 密钥才会生效
+func tlsListener(l net.Listener, s *http.Server) net.Listener {
+	// 同 ServeTLS, 总是支持 HTTP/1.1
+	if !slices.Contains(s.TLSConfig.NextProtos, "http/1.1") {
+		s.TLSConfig.NextProtos = append(s.TLSConfig.NextProtos, "http/1.1")
+	}
+	return tls.NewListener(l, s.TLSConfig)
+}
+
+// hstsHandler 为 https 请求加上 Strict-Transport-Security 头
+func hstsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", hsts)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
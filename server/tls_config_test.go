@@ -0,0 +1,54 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// go test ./server -v -run TestTicketRotation
+func TestTicketRotation(t *testing.T) {
+	cert, err := selfSignedCert("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{*cert}, NextProtos: []string{"http/1.1"}}
+	keys, err := rotateTicketKeys(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &http.Server{TLSConfig: conf, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(tlsListener(l, s))
+	defer s.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, ClientSessionCache: tls.NewLRUClientSessionCache(8)},
+	}}
+	resumed := func() bool {
+		rsp, err := client.Get("https://" + l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		return rsp.TLS.DidResume
+	}
+	resumed()
+	if !resumed() {
+		t.Fatal("the session should be resumed with the current key")
+	}
+	// the ticket of the first key can't be decrypted once it is rotated out
+	for i := 0; i < 3; i++ {
+		if keys, err = rotateTicketKeys(conf, keys); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if resumed() {
+		t.Fatal("the listener still uses the keys of before the rotation")
+	}
+}
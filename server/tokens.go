@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API token 的权限
+const (
+	ScopeConfigsRead  = "configs:read"
+	ScopeConfigsWrite = "configs:write"
+	ScopeIssue        = "issue"
+	ScopeScripts      = "scripts"
+)
+
+var allScopes = []string{ScopeConfigsRead, ScopeConfigsWrite, ScopeIssue, ScopeScripts}
+
+// tokenPrefix 便于在日志和代码仓库中识别泄露的 token
+const tokenPrefix = "cbt_"
+
+// ApiToken 是机器客户端使用的 token, 只保存其 sha256
+type ApiToken struct {
+	Id     string   `json:"id"`
+	Name   string   `json:"name"`
+	Hash   string   `json:"hash,omitempty"`
+	Scopes []string `json:"scopes"`
+	// 允许访问的配置, 为空时允许所有配置
+	ConfigIds []string   `json:"configIds,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Created   time.Time  `json:"created"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+}
+
+var (
+	apiTokens = make(map[string]*ApiToken)
+	tokensMu  sync.Mutex
+)
+
+func hashToken(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// findToken 返回 secret 对应的未过期的 token
+func findToken(secret string) *ApiToken {
+	hash := hashToken(secret)
+	now := time.Now()
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	for _, token := range apiTokens {
+		if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hash)) != 1 {
+			continue
+		}
+		if token.Expires != nil && now.After(*token.Expires) {
+			return nil
+		}
+		token.LastUsed = &now
+		return token
+	}
+	return nil
+}
+
+func (token *ApiToken) hasScope(scope string) bool {
+	return slices.Contains(token.Scopes, scope)
+}
+
+func (token *ApiToken) allowsConfig(configId string) bool {
+	return len(token.ConfigIds) == 0 || slices.Contains(token.ConfigIds, configId)
+}
+
+type tokenKey struct{}
+
+// requestToken 返回请求使用的 API token, 通过 OAuth 等方式认证的请求返回 nil
+func requestToken(r *http.Request) *ApiToken {
+	token, _ := r.Context().Value(tokenKey{}).(*ApiToken)
+	return token
+}
+
+// requestAllows 判断请求能否访问配置, 只有 API token 会限制配置
+func requestAllows(r *http.Request, configId string) bool {
+	token := requestToken(r)
+	return token == nil || token.allowsConfig(configId)
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[7:]), true
+}
+
+func writeAuthError(w http.ResponseWriter, status int, errCode int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	bytes, _ := json.Marshal(&HttpResult{Err: errCode, Data: msg})
+	w.Write(bytes)
+}
+
+// TokenHF 除了 AuthHF 的认证方式, 还接受 Authorization: Bearer 的 API token.
+// GET 请求需要 getScope, 其它请求需要 postScope; configIdParam 时 GET 请求 query 中的 id 是配置 id, 须在 token 的 configIds 中.
+// 其它请求的配置 id 可能在 body 中(如 POST /api/config), 由 handler 用 requestAllows 检查
+func TokenHF(getScope string, postScope string, configIdParam bool, h http.HandlerFunc) http.HandlerFunc {
+	authed := AuthHF(h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret, ok := bearerToken(r)
+		if !ok {
+			authed(w, r)
+			return
+		}
+		token := findToken(secret)
+		if token == nil {
+			writeAuthError(w, http.StatusUnauthorized, 4011, "The token is not valid or expired")
+			return
+		}
+		scope := postScope
+		if r.Method == "GET" {
+			scope = getScope
+		}
+		if !token.hasScope(scope) {
+			writeAuthError(w, http.StatusForbidden, 4012, "The token has no scope "+scope)
+			return
+		}
+		if configIdParam && r.Method == "GET" && !token.allowsConfig(r.URL.Query().Get("id")) {
+			writeAuthError(w, http.StatusForbidden, 4013, "The token is not allowed to access this config")
+			return
+		}
+		log.Println("api token:", token.Name, r.RequestURI)
+		h(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, token)))
+	}
+}
+
+// newTokenRequest 是创建 token 的请求, ttl 为空时不过期
+type newTokenRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ConfigIds []string `json:"configIds"`
+	Ttl       string   `json:"ttl"`
+}
+
+func newApiToken(req newTokenRequest) (*ApiToken, string, map[string]interface{}) {
+	fieldErrs := make(map[string]interface{})
+	if strings.TrimSpace(req.Name) == "" {
+		fieldErrs["name"] = "should not be empty"
+	}
+	if len(req.Scopes) == 0 {
+		fieldErrs["scopes"] = fmt.Sprintf("should not be empty, use %s", strings.Join(allScopes, ", "))
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(allScopes, scope) {
+			fieldErrs["scopes"] = fmt.Sprintf("%q is not a scope, use %s", scope, strings.Join(allScopes, ", "))
+		}
+	}
+	now := time.Now()
+	var expires *time.Time
+	if req.Ttl != "" {
+		ttl, err := time.ParseDuration(req.Ttl)
+		if err != nil || ttl <= 0 {
+			fieldErrs["ttl"] = "should be a duration like 720h"
+		} else {
+			t := now.Add(ttl)
+			expires = &t
+		}
+	}
+	if len(fieldErrs) > 0 {
+		return nil, "", fieldErrs
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", map[string]interface{}{"token": err.Error()}
+	}
+	secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &ApiToken{
+		Id:        hex.EncodeToString(id),
+		Name:      req.Name,
+		Hash:      hashToken(secret),
+		Scopes:    req.Scopes,
+		ConfigIds: req.ConfigIds,
+		Expires:   expires,
+		Created:   now,
+	}, secret, nil
+}
+
+// handleTokens 管理 API token: GET 列出, POST 创建(只在此时返回 token), DELETE 吊销.
+// token 不能管理 token, 只接受 AuthHF 的认证方式
+func handleTokens(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	errCode, data := _handleTokens(r)
+	bytes, _ := json.Marshal(&HttpResult{Err: errCode, Data: data})
+	w.Write(bytes)
+}
+
+func _handleTokens(r *http.Request) (int, interface{}) {
+	switch r.Method {
+	case "GET":
+		tokensMu.Lock()
+		defer tokensMu.Unlock()
+		list := make([]ApiToken, 0, len(apiTokens))
+		for _, token := range apiTokens {
+			t := *token
+			t.Hash = ""
+			list = append(list, t)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+		return 2000, list
+	case "POST":
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return 4001, fmt.Sprintf("Error reading request body: %+v", err)
+		}
+		defer r.Body.Close()
+		var req newTokenRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return 4002, fmt.Sprintf("Error unmarshaling request body: %+v", err)
+		}
+		token, secret, fieldErrs := newApiToken(req)
+		if len(fieldErrs) > 0 {
+			return 4003, fieldErrs
+		}
+		tokensMu.Lock()
+		apiTokens[token.Id] = token
+		tokensMu.Unlock()
+		saveTokens()
+		return 2000, map[string]interface{}{"id": token.Id, "token": secret, "expires": token.Expires}
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		tokensMu.Lock()
+		_, ok := apiTokens[id]
+		delete(apiTokens, id)
+		tokensMu.Unlock()
+		if !ok {
+			return 4000, "No id matched!!!"
+		}
+		saveTokens()
+		return 2000, "ok"
+	}
+	return 4009, "Method not allowed"
+}
+
+// saveTokens 把 token 的 hash 写入 TokensFile, 未设置时 token 只保存在内存中
+func saveTokens() {
+	if tokensFile == "" {
+		return
+	}
+	tokensMu.Lock()
+	raw, err := json.MarshalIndent(apiTokens, "", "  ")
+	tokensMu.Unlock()
+	if err != nil {
+		log.Printf("Error encoding tokens: %v\n", err)
+		return
+	}
+	tmp := tokensFile + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		log.Printf("Error saving tokens: %v\n", err)
+		return
+	}
+	if err := os.Rename(tmp, tokensFile); err != nil {
+		log.Printf("Error saving tokens: %v\n", err)
+	}
+}
+
+// loadTokens 启动时从 TokensFile 读取 token
+func loadTokens() error {
+	if tokensFile == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(tokensFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading tokens file %q: %v", tokensFile, err)
+	}
+	tokens := make(map[string]*ApiToken)
+	if err := json.Unmarshal(raw, &tokens); err != nil {
+		return fmt.Errorf("error parsing tokens file %q: %v", tokensFile, err)
+	}
+	tokensMu.Lock()
+	apiTokens = tokens
+	tokensMu.Unlock()
+	log.Printf("Loaded %d tokens from %s\n", len(tokens), tokensFile)
+	return nil
+}
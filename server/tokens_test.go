@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func addTestToken(t *testing.T, req newTokenRequest) string {
+	token, secret, fieldErrs := newApiToken(req)
+	if len(fieldErrs) > 0 {
+		t.Fatal(fieldErrs)
+	}
+	tokensMu.Lock()
+	apiTokens[token.Id] = token
+	tokensMu.Unlock()
+	t.Cleanup(func() {
+		tokensMu.Lock()
+		delete(apiTokens, token.Id)
+		tokensMu.Unlock()
+	})
+	return secret
+}
+
+func serveToken(h http.HandlerFunc, method string, target string, body string, secret string) (int, HttpResult) {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+secret)
+	w := httptest.NewRecorder()
+	h(w, r)
+	var result HttpResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return w.Code, result
+}
+
+// go test ./server -v -run TestTokenHF
+func TestTokenHF(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		bytes, _ := json.Marshal(&HttpResult{Err: 2000, Data: "ok"})
+		w.Write(bytes)
+	}
+	h := TokenHF(ScopeConfigsRead, ScopeConfigsWrite, true, ok)
+	read := addTestToken(t, newTokenRequest{Name: "read", Scopes: []string{ScopeConfigsRead}})
+	write := addTestToken(t, newTokenRequest{Name: "write", Scopes: []string{ScopeConfigsWrite}})
+
+	if code, result := serveToken(h, "GET", "/api/config?id=a", "", read); code != 200 || result.Err != 2000 {
+		t.Errorf("read token GET: %d %+v", code, result)
+	}
+	if code, result := serveToken(h, "POST", "/api/config", "{}", read); code != 403 || result.Err != 4012 {
+		t.Errorf("read token POST: %d %+v", code, result)
+	}
+	if code, result := serveToken(h, "GET", "/api/config?id=a", "", write); code != 403 || result.Err != 4012 {
+		t.Errorf("write token GET: %d %+v", code, result)
+	}
+	if code, _ := serveToken(h, "GET", "/api/config?id=a", "", "cbt_unknown"); code != 401 {
+		t.Errorf("unknown token: %d", code)
+	}
+}
+
+// go test ./server -v -run TestTokenHFConfigIds
+func TestTokenHFConfigIds(t *testing.T) {
+	h := TokenHF(ScopeConfigsRead, ScopeConfigsWrite, true, handleConfig)
+	secret := addTestToken(t, newTokenRequest{Name: "scoped", Scopes: []string{ScopeConfigsRead, ScopeConfigsWrite}, ConfigIds: []string{"mine"}})
+
+	if code, result := serveToken(h, "GET", "/api/config?id=other", "", secret); code != 403 || result.Err != 4013 {
+		t.Errorf("GET of another config: %d %+v", code, result)
+	}
+	// the id of a POST is in the body, the config is not valid so it is rejected after the allowlist
+	if _, result := serveToken(h, "POST", "/api/config", `{"id":"mine"}`, secret); result.Err != 4003 {
+		t.Errorf("POST of its own config: %+v", result)
+	}
+	if _, result := serveToken(h, "POST", "/api/config", `{"id":"other"}`, secret); result.Err != 4013 {
+		t.Errorf("POST of another config: %+v", result)
+	}
+}
+
+// go test ./server -v -run TestTokenHFExpired
+func TestTokenHFExpired(t *testing.T) {
+	h := TokenHF(ScopeConfigsRead, ScopeConfigsWrite, false, getConfigs)
+	secret := addTestToken(t, newTokenRequest{Name: "expired", Scopes: []string{ScopeConfigsRead}, Ttl: "1h"})
+	tokensMu.Lock()
+	for _, token := range apiTokens {
+		if token.Name == "expired" {
+			expired := time.Now().Add(-time.Minute)
+			token.Expires = &expired
+		}
+	}
+	tokensMu.Unlock()
+	if code, result := serveToken(h, "GET", "/api/configs", "", secret); code != 401 || result.Err != 4011 {
+		t.Errorf("expired token: %d %+v", code, result)
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+type unixSocketKey struct{}
+
+// isUnixSocket 判断请求是否来自 unix socket, 其权限由 socket 文件控制, 不需要 OAuth
+func isUnixSocket(r *http.Request) bool {
+	unix, _ := r.Context().Value(unixSocketKey{}).(bool)
+	return unix
+}
+
+// newServerForUnix 在 BindUnix 上提供与 BindAddr 相同的 API
+func newServerForUnix() *http.Server {
+	return &http.Server{
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, unixSocketKey{}, true)
+		},
+	}
+}
+
+// unixListener 关闭时删除 socket 文件, socket 是移动过来的, net 包只会删除原来的路径
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// listenUnix 监听 unix socket 并设置文件权限
+// socket 先在 0700 的临时目录中创建并 chmod, 再移动到 path, 因此不会有以默认权限可连接的时刻
+// 已存在的 socket 文件(上次未正常退出)会被删除, 但仍有实例在监听时报错
+func listenUnix(path string, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("BindUnixMode %q is not a valid file mode: %v", mode, err)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("socket %s is in use by another instance", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("error removing stale socket %s: %v", path, err)
+		}
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".cert_bot-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating the directory of socket %s: %v", path, err)
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, os.FileMode(perm)); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("error setting the mode of socket %s: %v", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("error moving socket to %s: %v", path, err)
+	}
+	return &unixListener{UnixListener: l, path: path}, nil
+}